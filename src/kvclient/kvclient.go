@@ -5,17 +5,29 @@ import (
     "errors"
     "fmt"
     "io/ioutil"
+    "math/rand"
     "net/http"
     "net/url"
+    "strconv"
     "strings"
+    "sync"
+    "time"
 )
 
+// The writes of a client are numbered in its session, so that a write is
+// retried on the next server without taking effect twice. The writes of a
+// client run one at a time.
 type KVClient struct {
     ip []string
+    id int64
+    seq int
+    lock sync.Mutex
 }
 
 func NewKVClient() (*KVClient, error) {
     kvclient := &KVClient{}
+    kvclient.id = rand.Int63n(1 << 62) + 1
+    kvclient.seq = 0
 
     bytes, err := ioutil.ReadFile("conf/settings.conf")
     if err != nil {
@@ -50,16 +62,38 @@ func NewKVClient() (*KVClient, error) {
     return kvclient, nil
 }
 
-func (kvclient *KVClient) Insert(key string, value string) ([]byte, error) {
+// Send a write to the servers in turn, until one of them answers
+func (kvclient *KVClient) write(path string, form url.Values) ([]byte, error) {
+    kvclient.lock.Lock()
+    defer kvclient.lock.Unlock()
+
+    kvclient.seq++
+    form.Set("client", strconv.FormatInt(kvclient.id, 10))
+    form.Set("seq", strconv.Itoa(kvclient.seq))
+
+    var err error
     for i := 0; i < len(kvclient.ip); i++ {
-        resp, err := http.PostForm("http://" + kvclient.ip[i] + "/kv/insert", url.Values{"key":{key}, "value":{value}})
+        var resp *http.Response
+        resp, err = http.PostForm("http://" + kvclient.ip[i] + path, form)
         if err != nil {
-            return make([]byte, 0), err
+            continue
         }
         defer resp.Body.Close()
         return ioutil.ReadAll(resp.Body)
     }
-    return make([]byte, 0), errors.New("all servers failed")
+    if err == nil {
+        err = errors.New("all servers failed")
+    }
+    return make([]byte, 0), err
+}
+
+func (kvclient *KVClient) Insert(key string, value string) ([]byte, error) {
+    return kvclient.write("/kv/insert", url.Values{"key":{key}, "value":{value}})
+}
+
+// Same as Insert, but the key expires after ttl
+func (kvclient *KVClient) InsertTTL(key string, value string, ttl time.Duration) ([]byte, error) {
+    return kvclient.write("/kv/insert", url.Values{"key":{key}, "value":{value}, "ttl":{milliseconds(ttl)}})
 }
 
 func (kvclient *KVClient) Get(key string) ([]byte, error) {
@@ -75,27 +109,54 @@ func (kvclient *KVClient) Get(key string) ([]byte, error) {
 }
 
 func (kvclient *KVClient) Delete(key string) ([]byte, error) {
-    for i := 0; i < len(kvclient.ip); i++ {
-        resp, err := http.PostForm("http://" + kvclient.ip[i] + "/kv/delete", url.Values{"key":{key}})
-        if err != nil {
-            return make([]byte, 0), err
-        }
-        defer resp.Body.Close()
-        return ioutil.ReadAll(resp.Body)
-    }
-    return make([]byte, 0), errors.New("all servers failed")
+    return kvclient.write("/kv/delete", url.Values{"key":{key}})
 }
 
 func (kvclient *KVClient) Update(key string, value string) ([]byte, error) {
-    for i := 0; i < len(kvclient.ip); i++ {
-        resp, err := http.PostForm("http://" + kvclient.ip[i] + "/kv/update", url.Values{"key":{key}, "value":{value}})
-        if err != nil {
-            return make([]byte, 0), err
-        }
-	    defer resp.Body.Close()
-        return ioutil.ReadAll(resp.Body)
+    return kvclient.write("/kv/update", url.Values{"key":{key}, "value":{value}})
+}
+
+// Same as Update, but the key expires after ttl
+func (kvclient *KVClient) UpdateTTL(key string, value string, ttl time.Duration) ([]byte, error) {
+    return kvclient.write("/kv/update", url.Values{"key":{key}, "value":{value}, "ttl":{milliseconds(ttl)}})
+}
+
+func milliseconds(d time.Duration) string {
+    return strconv.FormatInt(int64(d / time.Millisecond), 10)
+}
+
+func (kvclient *KVClient) CompareAndSwap(key string, expected string, value string) ([]byte, error) {
+    return kvclient.write("/kv/cas", url.Values{"key":{key}, "expected":{expected}, "value":{value}})
+}
+
+// A transaction as sent to "/kv/txn", in the JSON of kvpaxos.Transaction
+
+// The key is present with Value, or absent if Present is false
+type Check struct {
+    Key string
+    Present bool
+    Value string
+}
+
+// Type is "Set", which writes the key present or not, or "Delete"
+type Mutation struct {
+    Type string
+    Key string
+    Value string
+}
+
+type Transaction struct {
+    Checks []Check
+    Mutations []Mutation
+}
+
+// Apply the mutations of txn if all its checks hold, atomically
+func (kvclient *KVClient) Transact(txn Transaction) ([]byte, error) {
+    bytes, err := json.Marshal(txn)
+    if err != nil {
+        return make([]byte, 0), err
     }
-    return make([]byte, 0), errors.New("all servers failed")
+    return kvclient.write("/kv/txn", url.Values{"txn":{string(bytes)}})
 }
 
 func (kvclient *KVClient) Countkey() ([]byte, error) {
@@ -0,0 +1,176 @@
+package kvpaxos
+
+import (
+    "context"
+    "encoding/gob"
+    "time"
+)
+
+// Batching
+// The operations are queued, and the queued operations are proposed
+// together as one Batch per paxos instance. The operations of a batch are
+// applied in order.
+
+const defaultBatchSize = 32
+
+// At most this many batches are proposed at the same time, each in its
+// own instance
+const pipelineDepth = 8
+
+type Batch struct {
+    Ops []Proposal
+}
+
+func init() {
+    gob.RegisterName("Batch", Batch{})
+}
+
+type request struct {
+    p Proposal
+    ctx context.Context     // done once the caller gives up
+    done chan reply
+}
+
+type reply struct {
+    r result
+    err error
+}
+
+// At most size operations go in a batch, and a batch waits up to linger
+// for more operations once its first one is queued
+func (m *KVPaxosMap) SetBatching(size int, linger time.Duration) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    if size < 1 {
+        size = 1
+    }
+    m.batchSize = size
+    m.linger = linger
+}
+
+// Queue p for the next batch, and wait for its result
+func (m *KVPaxosMap) do(p Proposal) (result, error) {
+    m.lock.Lock()
+    ctx, cancel := m.context()
+    m.lock.Unlock()
+    defer cancel()
+
+    req := &request{p, ctx, make(chan reply, 1)}
+    select {
+    case m.requests <- req:
+    case <-ctx.Done():
+        return result{}, ErrTimeout
+    case <-m.shutdown:
+        return result{}, ErrDead
+    }
+
+    select {
+    case rep := <-req.done:
+        return rep.r, rep.err
+    case <-ctx.Done():
+        return result{}, ErrTimeout
+    case <-m.shutdown:
+        return result{}, ErrDead
+    }
+}
+
+// Collect the queued operations into one batch
+// Returns nil once the replica is shut down
+func (m *KVPaxosMap) collect() []*request {
+    var first *request
+    select {
+    case first = <-m.requests:
+    case <-m.shutdown:
+        return nil
+    }
+
+    m.lock.Lock()
+    size, linger := m.batchSize, m.linger
+    m.lock.Unlock()
+
+    reqs := []*request{first}
+    timeout := time.After(linger)
+    for len(reqs) < size {
+        if linger > 0 {
+            select {
+            case req := <-m.requests:
+                reqs = append(reqs, req)
+                continue
+            case <-timeout:
+            case <-m.shutdown:
+            }
+        } else {
+            select {
+            case req := <-m.requests:
+                reqs = append(reqs, req)
+                continue
+            default:
+            }
+        }
+        break
+    }
+    return reqs
+}
+
+// Propose the batches, up to pipelineDepth at the same time
+func (m *KVPaxosMap) run() {
+    defer m.wg.Done()
+
+    for {
+        reqs := m.collect()
+        if reqs == nil {
+            return
+        }
+        select {
+        case m.inflight <- struct{}{}:
+        case <-m.shutdown:
+            for _, req := range reqs {
+                req.done <- reply{result{}, ErrDead}
+            }
+            return
+        }
+        m.wg.Add(1)
+        go m.propose(reqs)
+    }
+}
+
+// A batch gives up once every operation in it does
+func batchContext(reqs []*request) (context.Context, context.CancelFunc) {
+    var latest time.Time
+    for _, req := range reqs {
+        d, ok := req.ctx.Deadline()
+        if !ok {
+            return context.WithCancel(context.Background())
+        }
+        if d.After(latest) {
+            latest = d
+        }
+    }
+    return context.WithDeadline(context.Background(), latest)
+}
+
+func (m *KVPaxosMap) propose(reqs []*request) {
+    defer m.wg.Done()
+    defer func() { <-m.inflight }()
+
+    ops := make([]Proposal, len(reqs))
+    for i, req := range reqs {
+        ops[i] = req.p
+    }
+
+    ctx, cancel := batchContext(reqs)
+    defer cancel()
+
+    m.lock.Lock()
+    rs, err := m.execute(ctx, Batch{ops})
+    m.lock.Unlock()
+
+    for i, req := range reqs {
+        if err != nil {
+            req.done <- reply{result{}, err}
+        } else {
+            req.done <- reply{rs[i], nil}
+        }
+    }
+}
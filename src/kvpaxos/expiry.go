@@ -0,0 +1,92 @@
+package kvpaxos
+
+import (
+    "errors"
+    "math/rand"
+    "time"
+)
+
+// Expiry
+// A write with a TTL carries the time its key expires, read from the clock
+// of the replica that proposes it. The keys are not removed by the clocks
+// of the replicas, but by a Tick decided in the log, so that every replica
+// removes them at the same instance. A key stays readable after it expires
+// until the next Tick.
+
+// A replica proposes a Tick this often, when it knows of an expired key
+const tickInterval = 100 * time.Millisecond
+
+var ErrBadTTL = errors.New("TTL must be positive")
+
+// The time a key written now with ttl expires at
+func deadline(ttl time.Duration) (int64, error) {
+    if ttl <= 0 {
+        return 0, ErrBadTTL
+    }
+    return time.Now().Add(ttl).UnixNano(), nil
+}
+
+// Must acquire m.lock
+// Write key, to expire at expires, or never if it is 0
+func (m *KVPaxosMap) set(key string, value string, expires int64) {
+    m.data[key] = value
+    if expires != 0 {
+        m.expires[key] = expires
+    } else {
+        delete(m.expires, key)
+    }
+}
+
+// Must acquire m.lock
+func (m *KVPaxosMap) remove(key string) {
+    delete(m.data, key)
+    delete(m.expires, key)
+}
+
+// Must acquire m.lock
+// Apply a Tick at time now, which never moves back
+func (m *KVPaxosMap) expire(now int64) {
+    if now > m.now {
+        m.now = now
+    }
+    for key, expires := range m.expires {
+        if expires <= m.now {
+            m.remove(key)
+        }
+    }
+}
+
+// Must acquire m.lock
+// Whether a key expires by now, as seen by this replica
+func (m *KVPaxosMap) due(now int64) bool {
+    for _, expires := range m.expires {
+        if expires <= now {
+            return true
+        }
+    }
+    return false
+}
+
+// Propose a Tick when a key expires
+// Several replicas may propose one for the same keys, and the later Ticks
+// remove nothing.
+func (m *KVPaxosMap) ticker() {
+    defer m.wg.Done()
+
+    for {
+        select {
+        case <-time.After(tickInterval):
+        case <-m.shutdown:
+            return
+        }
+
+        m.lock.Lock()
+        now := time.Now().UnixNano()
+        if m.err == nil && m.due(now) {
+            ctx, cancel := m.context()
+            m.execute(ctx, Proposal{"Tick", "", "", rand.Int63(), 0, 0, "", nil, now})
+            cancel()
+        }
+        m.lock.Unlock()
+    }
+}
@@ -3,26 +3,113 @@ package kvpaxos
 import (
     "paxos"
 
+    "bytes"
+    "context"
     "encoding/gob"
+    "errors"
+    "math/rand"
+    "reflect"
     "sync"
     "time"
 )
 
+// A hole left by a dead proposer is filled with Null after this long
+const holeTimeout = 1 * time.Second
+
+// A snapshot is handed to paxos after this many instances are applied,
+// and the instances before it are forgotten
+const snapshotInterval = 100
+const configWindow = 10
+
+var ErrDead = errors.New("replica is shut down")
+var ErrForgotten = errors.New("instance forgotten without a snapshot")
+var ErrLost = errors.New("result of the operation is lost")
+var ErrBadSnapshot = errors.New("snapshot cannot be decoded")
+var ErrTimeout = errors.New("operation timed out")
+
+// An operation gives up after this long, unless SetTimeout changes it
+const defaultTimeout = 10 * time.Second
+
+// The results of the writes are kept this many instances, for the replicas
+// that proposed them but are caught up by a snapshot
+const resultWindow = 10 * snapshotInterval
+
 type KVPaxosMap struct {
     lock sync.Mutex
     px *paxos.Paxos
+    faults *paxos.Faults
     done int
     data map[string]string
     dead bool
+    results map[int64]result        // by the id of the proposal
+    sessions map[int64]session      // by client
+    expires map[string]int64        // when the keys with a TTL expire
+    now int64                       // the time of the last Tick
+
+    decisions <-chan paxos.Decision
+    next int                        // next instance to receive from decisions
+    decided map[int]interface{}     // received but not applied yet
+    cond *sync.Cond                 // broadcast when m.done moves
+    slots map[int]*slot             // instances proposed here, by seq
+    reserved int                    // the highest instance proposed here
+    filling int                     // the hole a Null is proposed for
+    err error                       // why the applier stopped
+
+    timeout time.Duration           // of an operation, or 0 for none
+    batchSize int
+    linger time.Duration
+    requests chan *request          // queued for the next batch
+    inflight chan struct{}          // a token for every batch proposed
+    shutdown chan struct{}
+    wg sync.WaitGroup               // the applier, the ticker and the batches
+    once sync.Once
 }
 
 func NewKVPaxosMap(peers []string, me int) *KVPaxosMap {
+    return NewKVPaxosMapWithDir(peers, me, "")
+}
+
+// Same as NewKVPaxosMap, but the replica survives a restart with the
+// paxos log and snapshots kept under dir
+func NewKVPaxosMapWithDir(peers []string, me int, dir string) *KVPaxosMap {
+    return NewKVPaxosMapWithConfig(peers, peers, me, dir)
+}
+
+// Same as NewKVPaxosMapWithDir, but the group started with the replicas in
+// first, with "" for the others. A replica that is not in first waits for
+// Reconfigure to add it.
+func NewKVPaxosMapWithConfig(peers []string, first []string, me int, dir string) *KVPaxosMap {
     m := &KVPaxosMap{}
     m.lock = sync.Mutex{}
-    m.px = paxos.Make(peers, me, nil)
+    m.faults = paxos.NewFaults()
+    m.px = paxos.MakeReconfigurable(peers, first, configWindow, me, nil, dir, m.faults.Transport(peers[me], paxos.NewTCPTransport()))
+    // A dead replica is caught up by the snapshots
+    m.px.SetForgetPolicy(paxos.ForgetMajority)
     m.done = 0
     m.data = make(map[string]string)
     m.dead = false
+    m.results = make(map[int64]result)
+    m.sessions = make(map[int64]session)
+    m.expires = make(map[string]int64)
+    m.now = 0
+    m.decisions = m.px.Subscribe(0)
+    m.next = 0
+    m.decided = make(map[int]interface{})
+    m.cond = sync.NewCond(&m.lock)
+    m.slots = make(map[int]*slot)
+    m.reserved = -1
+    m.filling = -1
+    m.err = nil
+    m.timeout = defaultTimeout
+    m.batchSize = defaultBatchSize
+    m.linger = 0
+    m.requests = make(chan *request)
+    m.inflight = make(chan struct{}, pipelineDepth)
+    m.shutdown = make(chan struct{})
+    m.wg.Add(3)
+    go m.applier()
+    go m.ticker()
+    go m.run()
     return m
 }
 
@@ -32,190 +119,523 @@ type Proposal struct {
     Type string
     Key string
     Value string
-}
-
-func (p *Proposal) equalsTo(p_ *Proposal) bool {
-    return p.Type == p_.Type && p.Key == p_.Key && p.Value == p_.Value
+    Id int64    // tells apart the same operation proposed twice
+    Client int64    // the session of the operation, 0 if none
+    Seq int         // the number of the operation in its session
+    Expected string // the value CompareAndSwap replaces
+    Txn *Transaction
+    Expires int64   // in unix nanoseconds, when the key written expires, or
+                    // 0 for never; the time of a Tick
 }
 
 func init() {
     gob.RegisterName("Proposal", Proposal{})
 }
 
+// The value decided in an instance proposed here, and its results
+type slot struct {
+    v interface{}
+    rs []result
+    applied bool    // false if it is covered by a snapshot
+}
+
+// The result of a proposal applied at instance Seq
+type result struct {
+    Seq int
+    Ok bool
+    Value string
+    Count int
+}
+
 //--------------------------------------------------------------//
 
+// Snapshot of the replicated state
+
+type kvSnapshot struct {
+    Data map[string]string
+    Results map[int64]result
+    Sessions map[int64]session
+    Expires map[string]int64
+    Now int64
+}
+
 // Must acquire m.lock
-func (m *KVPaxosMap) waitDecide(seq int) {
-    to := 10 * time.Millisecond
+func (m *KVPaxosMap) takeSnapshot() []byte {
+    buf := bytes.Buffer{}
+    gob.NewEncoder(&buf).Encode(kvSnapshot{m.data, m.results, m.sessions, m.expires, m.now})
+    return buf.Bytes()
+}
+
+// Must acquire m.lock
+// Replace the state by a snapshot covering every instance <= seq
+func (m *KVPaxosMap) installSnapshot(seq int, snapshot []byte) error {
+    kv := kvSnapshot{}
+    if gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&kv) != nil {
+        return ErrBadSnapshot
+    }
+    m.data = kv.Data
+    if m.data == nil {
+        m.data = make(map[string]string)
+    }
+    m.results = kv.Results
+    if m.results == nil {
+        m.results = make(map[int64]result)
+    }
+    m.sessions = kv.Sessions
+    if m.sessions == nil {
+        m.sessions = make(map[int64]session)
+    }
+    m.expires = kv.Expires
+    if m.expires == nil {
+        m.expires = make(map[string]int64)
+    }
+    m.now = kv.Now
+    for ; m.done <= seq; m.done++ {
+        delete(m.decided, m.done)
+    }
+    m.px.Done(seq)
+    return nil
+}
+
+//--------------------------------------------------------------//
+
+// Receive the decisions in order, and apply them
+func (m *KVPaxosMap) applier() {
+    defer m.wg.Done()
+
+    retried := false
     for {
-        decided, _ := m.px.Status(seq)
-        if decided {
+        select {
+        case d, ok := <-m.decisions:
+            m.lock.Lock()
+            if !ok {
+                // The decisions end when the paxos peer is dead, or when the
+                // next instance is forgotten before it is delivered
+                if fate, _ := m.px.Status(m.next); fate != paxos.Forgotten {
+                    m.stop(ErrDead)
+                } else if retried {
+                    m.stop(ErrForgotten)
+                } else {
+                    // The snapshot that covers it comes first on a new subscription
+                    m.decisions = m.px.Subscribe(m.next)
+                    retried = true
+                }
+                stopped := m.err != nil
+                m.lock.Unlock()
+                if stopped {
+                    return
+                }
+                continue
+            }
+            retried = false
+            if d.Snapshot {
+                snapshot, _ := d.Value.([]byte)
+                if err := m.installSnapshot(d.Seq, snapshot); err != nil {
+                    // The instances it covers are not applied here
+                    m.stop(err)
+                    m.lock.Unlock()
+                    return
+                }
+            } else {
+                m.decided[d.Seq] = d.Value
+            }
+            m.next = d.Seq + 1
+            m.applyDecided()
+            m.cond.Broadcast()
+            m.lock.Unlock()
+        case <-time.After(holeTimeout):
+            // A hole left by a dead proposer, or a decision this replica
+            // missed, holds back the later instances even when the replica
+            // serves no request. Proposing Null either fills the hole or
+            // learns the value decided in it. The proposer keeps trying
+            // until the hole is decided, so one is started per hole.
+            m.lock.Lock()
+            if (m.reserved >= m.next || m.px.Max() >= m.next) && m.filling != m.next {
+                m.filling = m.next
+                m.px.Start(m.next, Proposal{"Null", "", "", 0, 0, 0, "", nil, 0})
+            }
+            m.lock.Unlock()
+        }
+    }
+}
+
+// Must acquire m.lock
+// Fail the operations in progress and the later ones with err
+func (m *KVPaxosMap) stop(err error) {
+    m.err = err
+    m.cond.Broadcast()
+}
+
+// Must acquire m.lock
+// Apply the instances received so far
+func (m *KVPaxosMap) applyDecided() {
+    for {
+        v, exist := m.decided[m.done]
+        if !exist {
             return
         }
-        time.Sleep(to)
-        if to < 10 * time.Second {
-            to *= 2
+        rs := m.apply(v)
+        if s := m.slots[m.done]; s != nil {
+            s.v, s.rs, s.applied = v, rs, true
         }
+        m.finishStep()
     }
 }
 
 // Must acquire m.lock
-func (m *KVPaxosMap) submitProposal(p Proposal) int {
-    for {
-        seq := m.px.Max() + 1
-        m.px.Start(seq, p)
-        m.waitDecide(seq)
-        _, tmp := m.px.Status(seq)
-        p_, _ := tmp.(Proposal)
-        if p.equalsTo(&p_) {
-            return seq
+// Finish applying the instance m.done
+func (m *KVPaxosMap) finishStep() {
+    delete(m.decided, m.done)
+    if (m.done + 1) % snapshotInterval == 0 {
+        for id, r := range m.results {
+            if r.Seq < m.done - resultWindow {
+                delete(m.results, id)
+            }
         }
+        m.pruneSessions(m.done - sessionWindow)
+        m.px.Snapshot(m.done, m.takeSnapshot())
+        m.px.Done(m.done)
+    }
+    m.done++
+}
+
+// The operations in a decided value
+func ops(v interface{}) []Proposal {
+    switch v := v.(type) {
+    case Batch:
+        return v.Ops
+    case Proposal:
+        return []Proposal{v}
     }
+    return nil
 }
 
 // Must acquire m.lock
-func (m *KVPaxosMap) doAStep() {
-    seq := m.done
-    if decided, _ := m.px.Status(seq); !decided {
-        m.px.Start(seq, Proposal{"Null", "", ""})
-        m.waitDecide(seq)
+// Apply the operations of v in order as the instance m.done
+func (m *KVPaxosMap) apply(v interface{}) []result {
+    ps := ops(v)
+    rs := make([]result, len(ps))
+    for i, p := range ps {
+        rs[i] = m.applyOp(p)
     }
+    return rs
+}
 
-    _, tmp := m.px.Status(seq)
-    p, _ := tmp.(Proposal)
+// Must acquire m.lock
+// Apply p, unless it or its session already did
+func (m *KVPaxosMap) applyOp(p Proposal) result {
+    if r, exist := m.results[p.Id]; exist && isWrite(p) && p.Id != 0 {
+        return r
+    }
+    r, replied := m.replied(p)
+    if !replied {
+        r = m.perform(p)
+        m.remember(p, r)
+    }
+    if isWrite(p) && p.Id != 0 {
+        m.results[p.Id] = r
+    }
+    return r
+}
+
+// Must acquire m.lock
+func (m *KVPaxosMap) perform(p Proposal) result {
+    r := result{m.done, false, "", 0}
     if p.Type == "Put" {
         if _, ok := m.data[p.Key]; !ok {
-            m.data[p.Key] = p.Value
+            m.set(p.Key, p.Value, p.Expires)
+            r.Ok = true
         }
+    } else if p.Type == "Get" {
+        r.Value, r.Ok = m.data[p.Key]
     } else if p.Type == "Update" {
         if _, ok := m.data[p.Key]; ok {
-            m.data[p.Key] = p.Value
+            m.set(p.Key, p.Value, p.Expires)
+            r.Ok = true
         }
     } else if p.Type == "Delete" {
-        delete(m.data, p.Key)
+        r.Value, r.Ok = m.data[p.Key]
+        m.remove(p.Key)
+    } else if p.Type == "CompareAndSwap" {
+        value, ok := m.data[p.Key]
+        r.Value = value
+        if ok && value == p.Expected {
+            m.set(p.Key, p.Value, 0)
+            r.Ok = true
+        }
+    } else if p.Type == "Tick" {
+        m.expire(p.Expires)
+        r.Ok = true
+    } else if p.Type == "Transaction" && p.Txn != nil {
+        r.Ok = m.transact(*p.Txn)
+    } else if p.Type == "Count" {
+        r.Ok, r.Count = true, len(m.data)
+    } else if p.Type == "Dump" {
+        r.Ok, r.Value = true, m.dump()
     }
-    m.px.Done(m.done)
-    m.done++
+    return r
 }
 
-//--------------------------------------------------------------//
-
-func (m *KVPaxosMap) Put(key string, value string) bool {
+// An operation gives up after d with ErrTimeout, and may or may not take
+// effect then. An operation never gives up if d is 0.
+func (m *KVPaxosMap) SetTimeout(d time.Duration) {
     m.lock.Lock()
     defer m.lock.Unlock()
 
-    if m.dead {
-        return false
-    }
+    m.timeout = d
+}
 
-    seq := m.submitProposal(Proposal{"Put", key, value})
-    for m.done < seq {
-        m.doAStep()
+// Must acquire m.lock
+// The context of an operation starting now
+func (m *KVPaxosMap) context() (context.Context, context.CancelFunc) {
+    if m.timeout <= 0 {
+        return context.WithCancel(context.Background())
     }
+    return context.WithTimeout(context.Background(), m.timeout)
+}
 
-    result := false
-    if _, ok := m.data[key]; !ok {
-        m.data[key] = value
-        result = true
+// Must acquire m.lock
+// Propose v, and wait for the applier to apply it, until ctx is done
+// Returns the result of every operation of v
+// m.lock is released while waiting, so that the operations in other
+// instances are proposed meanwhile.
+func (m *KVPaxosMap) execute(ctx context.Context, v interface{}) ([]result, error) {
+    // Wake up the wait below once ctx is done
+    stop := context.AfterFunc(ctx, func() {
+        m.lock.Lock()
+        defer m.lock.Unlock()
+        m.cond.Broadcast()
+    })
+    defer stop()
+
+    for m.err == nil {
+        seq := m.px.Max() + 1
+        if seq <= m.reserved {
+            seq = m.reserved + 1
+        }
+        if seq < m.next {
+            seq = m.next
+        }
+        m.reserved = seq
+        s := &slot{}
+        m.slots[seq] = s
+        // A proposer given up leaves a hole, which the applier fills
+        m.px.StartContext(ctx, seq, v)
+
+        for m.done <= seq && m.err == nil && ctx.Err() == nil {
+            m.cond.Wait()
+        }
+        delete(m.slots, seq)
+        if m.err != nil {
+            break
+        }
+        if m.done <= seq {
+            return nil, ErrTimeout
+        }
+        if s.applied {
+            if proposed(s.v, v) {
+                return s.rs, nil
+            }
+            continue
+        }
+        if rs, decided, err := m.covered(seq, v); decided {
+            return rs, err
+        }
     }
-    m.px.Done(m.done)
-    m.done++
-    return result
+    return nil, m.err
 }
 
-func (m *KVPaxosMap) Get(key string) (bool, string) {
-    m.lock.Lock()
-    defer m.lock.Unlock()
-
-    if m.dead {
-        return false, ""
+// Whether the value decided is v, proposed here
+// The operations are told apart by their ids, as a value decoded by gob
+// may differ from the one proposed, without its empty slices.
+func proposed(decided interface{}, v interface{}) bool {
+    ps, qs := ops(decided), ops(v)
+    if len(qs) == 0 {
+        return reflect.DeepEqual(decided, v)
     }
-
-    seq := m.submitProposal(Proposal{"Get", key, ""})
-    for m.done < seq {
-        m.doAStep()
+    if len(ps) != len(qs) {
+        return false
     }
+    for i := range qs {
+        if ps[i].Id != qs[i].Id {
+            return false
+        }
+    }
+    return true
+}
 
-    v, ok := m.data[key]
-    m.px.Done(m.done)
-    m.done++
-    return ok, v
+func isWrite(p Proposal) bool {
+    return p.Type == "Put" || p.Type == "Update" || p.Type == "Delete" || p.Type == "CompareAndSwap" ||
+        p.Type == "Transaction"
 }
 
-func (m *KVPaxosMap) Update(key string, value string) bool {
-    m.lock.Lock()
-    defer m.lock.Unlock()
+func isRead(p Proposal) bool {
+    return p.Type == "Get" || p.Type == "Count" || p.Type == "Dump"
+}
 
-    if m.dead {
-        return false
+// Must acquire m.lock
+// The results of v, if its instance seq is covered by a snapshot
+// Returns false if v may not be decided, as the snapshot keeps the results
+// of the writes only, or if v reads. The snapshot may come from a peer
+// behind a write that finished before the read started, so the read is
+// proposed again, and the writes applied with it are not applied twice.
+func (m *KVPaxosMap) covered(seq int, v interface{}) ([]result, bool, error) {
+    switch v := v.(type) {
+    case Batch, Proposal:
+    case paxos.Reconfig:
+        // A Reconfig decided in seq or later starts a configuration after
+        // seq, which the snapshot carries
+        for _, c := range m.px.Configs() {
+            if c.Start > seq && reflect.DeepEqual(c.Peers, v.Peers) {
+                return nil, true, nil
+            }
+        }
+        return nil, false, nil
+    default:
+        return nil, true, nil
     }
 
-    seq := m.submitProposal(Proposal{"Update", key, value})
-    for m.done < seq {
-        m.doAStep()
+    ps := ops(v)
+    rs := make([]result, len(ps))
+    reads, writes, kept := 0, 0, 0
+    for i, p := range ps {
+        if isRead(p) {
+            reads++
+            continue
+        }
+        if !isWrite(p) {
+            // A Tick is applied by the snapshot, and must not change this
+            // replica alone
+            rs[i] = result{m.done, true, "", 0}
+            continue
+        }
+        writes++
+        if r, exist := m.results[p.Id]; exist {
+            rs[i] = r
+            kept++
+        } else if r, exist := m.replied(p); exist {
+            rs[i] = r
+            kept++
+        }
     }
-
-    result := false
-    if _, ok := m.data[key]; ok {
-        m.data[key] = value
-        result = true
+    if kept > 0 && kept < writes {
+        return nil, true, ErrLost
     }
-    m.px.Done(m.done)
-    m.done++
-    return result
+    if reads > 0 || kept < writes {
+        return nil, false, nil
+    }
+    return rs, true, nil
 }
 
-func (m *KVPaxosMap) Delete(key string) (bool, string) {
-    m.lock.Lock()
-    defer m.lock.Unlock()
+//--------------------------------------------------------------//
 
-    if m.dead {
-        return false, ""
-    }
+// The operations return an error when they may or may not take effect
 
-    seq := m.submitProposal(Proposal{"Delete", key, ""})
-    for m.done < seq {
-        m.doAStep()
-    }
+func (m *KVPaxosMap) Put(key string, value string) (bool, error) {
+    return m.PutIn(Session{}, key, value)
+}
 
-    v, ok := m.data[key]
-    delete(m.data, key)
-    m.px.Done(m.done)
-    m.done++
-    return ok, v
+// Same as Put, but the key expires after ttl
+func (m *KVPaxosMap) PutTTL(key string, value string, ttl time.Duration) (bool, error) {
+    return m.PutTTLIn(Session{}, key, value, ttl)
 }
 
-func (m *KVPaxosMap) Count() int {
-    m.lock.Lock()
-    defer m.lock.Unlock()
+func (m *KVPaxosMap) Get(key string) (bool, string, error) {
+    r, err := m.do(Proposal{"Get", key, "", rand.Int63(), 0, 0, "", nil, 0})
+    return r.Ok, r.Value, err
+}
 
-    if m.dead {
-        return -1
+// A write without a TTL makes the key never expire
+
+func (m *KVPaxosMap) Update(key string, value string) (bool, error) {
+    return m.UpdateIn(Session{}, key, value)
+}
+
+// Same as Update, but the key expires after ttl
+func (m *KVPaxosMap) UpdateTTL(key string, value string, ttl time.Duration) (bool, error) {
+    return m.UpdateTTLIn(Session{}, key, value, ttl)
+}
+
+func (m *KVPaxosMap) Delete(key string) (bool, string, error) {
+    return m.DeleteIn(Session{}, key)
+}
+
+// The writes in a session take effect once, however many times they are
+// retried with the same number
+
+func (m *KVPaxosMap) PutIn(s Session, key string, value string) (bool, error) {
+    r, err := m.do(Proposal{"Put", key, value, rand.Int63(), s.Client, s.Seq, "", nil, 0})
+    return r.Ok, err
+}
+
+func (m *KVPaxosMap) PutTTLIn(s Session, key string, value string, ttl time.Duration) (bool, error) {
+    expires, err := deadline(ttl)
+    if err != nil {
+        return false, err
     }
+    r, err := m.do(Proposal{"Put", key, value, rand.Int63(), s.Client, s.Seq, "", nil, expires})
+    return r.Ok, err
+}
 
-    seq := m.submitProposal(Proposal{"Count", "", ""})
-    for m.done < seq {
-        m.doAStep()
+func (m *KVPaxosMap) UpdateIn(s Session, key string, value string) (bool, error) {
+    r, err := m.do(Proposal{"Update", key, value, rand.Int63(), s.Client, s.Seq, "", nil, 0})
+    return r.Ok, err
+}
+
+func (m *KVPaxosMap) UpdateTTLIn(s Session, key string, value string, ttl time.Duration) (bool, error) {
+    expires, err := deadline(ttl)
+    if err != nil {
+        return false, err
     }
+    r, err := m.do(Proposal{"Update", key, value, rand.Int63(), s.Client, s.Seq, "", nil, expires})
+    return r.Ok, err
+}
 
-    m.px.Done(m.done)
-    m.done++
-    return len(m.data)
+func (m *KVPaxosMap) DeleteIn(s Session, key string) (bool, string, error) {
+    r, err := m.do(Proposal{"Delete", key, "", rand.Int63(), s.Client, s.Seq, "", nil, 0})
+    return r.Ok, r.Value, err
 }
 
-func (m *KVPaxosMap) Dump() string {
-    m.lock.Lock()
-    defer m.lock.Unlock()
+// Replace the value of key by value if it is expected
+// Returns the value found, which is the value replaced on success
+func (m *KVPaxosMap) CompareAndSwap(key string, expected string, value string) (bool, string, error) {
+    return m.CompareAndSwapIn(Session{}, key, expected, value)
+}
 
-    if m.dead {
-        return ""
+func (m *KVPaxosMap) CompareAndSwapIn(s Session, key string, expected string, value string) (bool, string, error) {
+    r, err := m.do(Proposal{"CompareAndSwap", key, value, rand.Int63(), s.Client, s.Seq, expected, nil, 0})
+    return r.Ok, r.Value, err
+}
+
+// Apply the mutations of t if all its checks hold
+// Returns false if a check fails, and nothing is changed then
+func (m *KVPaxosMap) Transact(t Transaction) (bool, error) {
+    return m.TransactIn(Session{}, t)
+}
+
+func (m *KVPaxosMap) TransactIn(s Session, t Transaction) (bool, error) {
+    if !t.valid() {
+        return false, ErrBadTransaction
     }
+    r, err := m.do(Proposal{"Transaction", "", "", rand.Int63(), s.Client, s.Seq, "", &t, 0})
+    return r.Ok, err
+}
 
-    seq := m.submitProposal(Proposal{"Dump", "", ""})
-    for m.done < seq {
-        m.doAStep()
+func (m *KVPaxosMap) Count() (int, error) {
+    r, err := m.do(Proposal{"Count", "", "", rand.Int63(), 0, 0, "", nil, 0})
+    if err != nil {
+        return -1, err
     }
+    return r.Count, nil
+}
 
+func (m *KVPaxosMap) Dump() (string, error) {
+    r, err := m.do(Proposal{"Dump", "", "", rand.Int63(), 0, 0, "", nil, 0})
+    return r.Value, err
+}
+
+// Must acquire m.lock
+func (m *KVPaxosMap) dump() string {
     cnt := 0
     size := len(m.data)
     info := "["
@@ -227,16 +647,40 @@ func (m *KVPaxosMap) Dump() string {
         }
     }
     info += "]"
-
-    m.px.Done(m.done)
-    m.done++
     return info
 }
 
-func (m *KVPaxosMap) Shutdown() {
+// Change the replicas of the group to peers, with "" for the slots out of it
+// The change takes effect a few instances after it is decided
+func (m *KVPaxosMap) Reconfigure(peers []string) error {
     m.lock.Lock()
     defer m.lock.Unlock()
 
-    m.dead = true
-    m.px.Kill()
+    if m.dead {
+        return ErrDead
+    }
+
+    ctx, cancel := m.context()
+    defer cancel()
+    _, err := m.execute(ctx, paxos.Reconfig{Peers: peers})
+    return err
+}
+
+// Faults injected into the RPCs this replica sends
+func (m *KVPaxosMap) Faults() *paxos.Faults {
+    return m.faults
+}
+
+// Killing the paxos peer stops the applier, which fails the operations in
+// progress
+func (m *KVPaxosMap) Shutdown() {
+    m.once.Do(func() {
+        close(m.shutdown)
+        m.px.Kill()
+        m.wg.Wait()
+
+        m.lock.Lock()
+        m.dead = true
+        m.lock.Unlock()
+    })
 }
\ No newline at end of file
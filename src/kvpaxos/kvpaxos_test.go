@@ -0,0 +1,652 @@
+package kvpaxos
+
+import "kvpaxos/linearizability"
+import "paxos"
+
+import "testing"
+import "runtime"
+import "net"
+import "fmt"
+import "math/rand"
+import "sync"
+import "sync/atomic"
+import "time"
+import "bytes"
+import "encoding/gob"
+
+func tcpports(n int) []string {
+    ports := make([]string, n)
+    for i := 0; i < n; i++ {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            panic(err)
+        }
+        ports[i] = l.Addr().String()
+        l.Close()
+    }
+    return ports
+}
+
+func makeCluster(n int) []*KVPaxosMap {
+    peers := tcpports(n)
+    ms := make([]*KVPaxosMap, n)
+    for i := 0; i < n; i++ {
+        ms[i] = NewKVPaxosMap(peers, i)
+    }
+    return ms
+}
+
+func cleanup(ms []*KVPaxosMap) {
+    for i := 0; i < len(ms); i++ {
+        ms[i].Shutdown()
+    }
+}
+
+// Run one operation on m, and record it in h
+func record(h *linearizability.History, client int, m *KVPaxosMap, in linearizability.Input) linearizability.Output {
+    id := h.Call(client, in)
+    out := linearizability.Output{}
+    var err error
+    switch in.Type {
+    case "Put":
+        out.Ok, err = m.Put(in.Key, in.Value)
+    case "Get":
+        out.Ok, out.Value, err = m.Get(in.Key)
+    case "Update":
+        out.Ok, err = m.Update(in.Key, in.Value)
+    case "Delete":
+        out.Ok, out.Value, err = m.Delete(in.Key)
+    case "CompareAndSwap":
+        out.Ok, out.Value, err = m.CompareAndSwap(in.Key, in.Expected, in.Value)
+    }
+
+    if err != nil {
+        h.Fail(id)
+    } else {
+        h.Return(id, out)
+    }
+    return out
+}
+
+func TestLinearizable(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Concurrent clients, a replica shut down ...\n")
+
+    const nreplicas = 3
+    const nclients = 5
+    ms := makeCluster(nreplicas)
+    defer cleanup(ms)
+
+    h := linearizability.NewHistory()
+    types := []string{"Put", "Get", "Update", "Delete", "CompareAndSwap"}
+    keys := []string{"a", "b", "c"}
+
+    var done int32
+    var wg sync.WaitGroup
+    for c := 0; c < nclients; c++ {
+        wg.Add(1)
+        go func(c int) {
+            defer wg.Done()
+            seen := ""  // a CompareAndSwap expects the last value seen
+            for i := 0; atomic.LoadInt32(&done) == 0; i++ {
+                r := rand.Intn(nreplicas)
+                in := linearizability.Input{
+                    Type: types[rand.Intn(len(types))],
+                    Key: keys[rand.Intn(len(keys))],
+                    Value: fmt.Sprintf("%v-%v", c, i),
+                    Expected: seen,
+                }
+                if out := record(h, c, ms[r], in); out.Value != "" {
+                    seen = out.Value
+                }
+            }
+        }(c)
+    }
+
+    time.Sleep(2 * time.Second)
+    ms[nreplicas - 1].Shutdown()
+    if _, err := ms[nreplicas - 1].Put("a", "x"); err != ErrDead {
+        t.Fatalf("Put on a replica shut down returned %v; wanted ErrDead", err)
+    }
+    time.Sleep(3 * time.Second)
+    atomic.StoreInt32(&done, 1)
+    wg.Wait()
+
+    ops := h.Operations()
+    if len(ops) < 10 {
+        t.Fatalf("too few operations; got %v", len(ops))
+    }
+    if ok, key := linearizability.Check(ops); !ok {
+        t.Fatalf("history of key %v is not linearizable", key)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestBatching(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    const nops = 64
+
+    ms := makeCluster(3)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: Concurrent operations share instances ...\n")
+
+    ms[0].SetBatching(32, 20 * time.Millisecond)
+
+    var failed int32
+    var wg sync.WaitGroup
+    for i := 0; i < nops; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            if ok, err := ms[0].Put(fmt.Sprintf("k%v", i), "v"); !ok || err != nil {
+                atomic.StoreInt32(&failed, 1)
+            }
+        }(i)
+    }
+    wg.Wait()
+    if failed != 0 {
+        t.Fatalf("a Put failed")
+    }
+
+    if count, err := ms[1].Count(); count != nops || err != nil {
+        t.Fatalf("wrong count; got %v, %v; wanted %v", count, err, nops)
+    }
+    if max := ms[0].px.Max(); max >= nops / 2 {
+        t.Fatalf("too many instances for %v operations; got %v", nops, max + 1)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestPipeline(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    const nops = 40
+    const delay = 25 * time.Millisecond
+
+    ms := makeCluster(3)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: Concurrent instances are proposed together ...\n")
+
+    // One operation per instance, so that every one takes a round trip
+    ms[0].SetBatching(1, 0)
+    ms[0].Faults().SetDelay(delay)
+
+    start := time.Now()
+    var failed int32
+    var wg sync.WaitGroup
+    for i := 0; i < nops; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            if ok, err := ms[0].Put(fmt.Sprintf("k%v", i), "v"); !ok || err != nil {
+                atomic.StoreInt32(&failed, 1)
+            }
+        }(i)
+    }
+    wg.Wait()
+    if failed != 0 {
+        t.Fatalf("a Put failed")
+    }
+
+    // One instance at a time takes at least two delays per instance
+    if elapsed := time.Since(start); elapsed > nops * delay {
+        t.Fatalf("instances are not proposed concurrently; took %v", elapsed)
+    }
+    if count, err := ms[1].Count(); count != nops || err != nil {
+        t.Fatalf("wrong count; got %v, %v; wanted %v", count, err, nops)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestIdleReplica(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    ms := makeCluster(3)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: Idle replicas fill the holes in the log ...\n")
+
+    // Instance 0 is left as if its proposer died, and no replica serves
+    // a request afterwards
+    ms[0].px.Start(1, Proposal{"Put", "a", "x", 1, 0, 0, "", nil, 0})
+
+    for iters := 0; ; iters++ {
+        caught := true
+        for i := 0; i < 3; i++ {
+            ms[i].lock.Lock()
+            if ms[i].done < 2 || ms[i].data["a"] != "x" {
+                caught = false
+            }
+            ms[i].lock.Unlock()
+        }
+        if caught {
+            break
+        }
+        if iters >= 50 {
+            t.Fatalf("idle replicas did not apply the instance after the hole")
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestSessions(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    ms := makeCluster(3)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: Retried writes take effect once ...\n")
+
+    s := Session{Client: 7, Seq: 1}
+    for i := 0; i < 3; i++ {
+        if ok, err := ms[i].PutIn(s, "a", "x"); !ok || err != nil {
+            t.Fatalf("retried Put on replica %v; got %v, %v; wanted true", i, ok, err)
+        }
+    }
+
+    s.Seq++
+    for i := 0; i < 3; i++ {
+        if ok, v, err := ms[i].DeleteIn(s, "a"); !ok || v != "x" || err != nil {
+            t.Fatalf("retried Delete on replica %v; got %v, %v, %v", i, ok, v, err)
+        }
+    }
+
+    // The retries do not undo the writes of other clients
+    if ok, err := ms[0].PutIn(Session{Client: 8, Seq: 1}, "a", "y"); !ok || err != nil {
+        t.Fatalf("Put failed; got %v, %v", ok, err)
+    }
+    if ok, _, err := ms[1].DeleteIn(s, "a"); !ok || err != nil {
+        t.Fatalf("retried Delete; got %v, %v", ok, err)
+    }
+    if ok, v, err := ms[2].Get("a"); !ok || v != "y" || err != nil {
+        t.Fatalf("Get; got %v, %v, %v; wanted y", ok, v, err)
+    }
+
+    // An operation older than the last one of its client fails
+    if ok, err := ms[0].PutIn(Session{Client: 7, Seq: 1}, "b", "x"); ok || err != nil {
+        t.Fatalf("old Put; got %v, %v; wanted false", ok, err)
+    }
+    if ok, _, _ := ms[0].Get("b"); ok {
+        t.Fatalf("old Put took effect")
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestSessionExpiry(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    ms := makeCluster(1)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: Idle sessions are dropped ...\n")
+
+    m := ms[0]
+    if ok, err := m.PutIn(Session{Client: 1, Seq: 1}, "a", "x"); !ok || err != nil {
+        t.Fatalf("Put failed; got %v, %v", ok, err)
+    }
+    // Client 2 stays active, and client 1 is idle
+    for i := 1; i <= sessionWindow + snapshotInterval; i++ {
+        if _, err := m.PutIn(Session{Client: 2, Seq: i}, "b", "y"); err != nil {
+            t.Fatalf("Put failed; got %v", err)
+        }
+    }
+
+    m.lock.Lock()
+    _, idle := m.sessions[1]
+    _, active := m.sessions[2]
+    m.lock.Unlock()
+    if idle {
+        t.Fatalf("idle session kept")
+    }
+    if !active {
+        t.Fatalf("active session dropped")
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestCompareAndSwap(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    ms := makeCluster(3)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: Compare and swap ...\n")
+
+    if ok, v, err := ms[0].CompareAndSwap("a", "x", "y"); ok || v != "" || err != nil {
+        t.Fatalf("swap of a missing key; got %v, %v, %v", ok, v, err)
+    }
+    ms[0].Put("a", "x")
+    if ok, v, err := ms[1].CompareAndSwap("a", "z", "y"); ok || v != "x" || err != nil {
+        t.Fatalf("swap with a wrong value; got %v, %v, %v", ok, v, err)
+    }
+    if ok, v, err := ms[2].CompareAndSwap("a", "x", "y"); !ok || v != "x" || err != nil {
+        t.Fatalf("swap; got %v, %v, %v", ok, v, err)
+    }
+    if _, v, _ := ms[0].Get("a"); v != "y" {
+        t.Fatalf("wrong value after the swap; got %v; wanted y", v)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestTransaction(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    ms := makeCluster(3)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: Transactions are applied all or nothing ...\n")
+
+    ms[0].Put("a", "1")
+    ms[0].Put("b", "2")
+
+    swap := Transaction{
+        Checks: []Check{{"a", true, "1"}, {"b", true, "2"}, {"c", false, ""}},
+        Mutations: []Mutation{{"Set", "a", "2"}, {"Set", "b", "1"}, {"Delete", "d", ""}},
+    }
+    if ok, err := ms[1].Transact(swap); !ok || err != nil {
+        t.Fatalf("transaction failed; got %v, %v", ok, err)
+    }
+    if _, v, _ := ms[2].Get("a"); v != "2" {
+        t.Fatalf("wrong value of a; got %v; wanted 2", v)
+    }
+    if _, v, _ := ms[2].Get("b"); v != "1" {
+        t.Fatalf("wrong value of b; got %v; wanted 1", v)
+    }
+
+    // The checks no longer hold
+    swap.Mutations = append(swap.Mutations, Mutation{"Set", "c", "3"})
+    if ok, err := ms[2].Transact(swap); ok || err != nil {
+        t.Fatalf("transaction with a failed check; got %v, %v", ok, err)
+    }
+    if ok, _, _ := ms[0].Get("c"); ok {
+        t.Fatalf("mutation of a failed transaction applied")
+    }
+    if _, v, _ := ms[0].Get("a"); v != "2" {
+        t.Fatalf("mutation of a failed transaction applied")
+    }
+
+    bad := Transaction{nil, []Mutation{{"Put", "c", "3"}}}
+    if _, err := ms[0].Transact(bad); err != ErrBadTransaction {
+        t.Fatalf("unknown mutation; got %v; wanted ErrBadTransaction", err)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestExpiry(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    const ttl = 300 * time.Millisecond
+
+    ms := makeCluster(3)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: Keys with a TTL expire on every replica ...\n")
+
+    if _, err := ms[0].PutTTL("a", "x", 0); err != ErrBadTTL {
+        t.Fatalf("zero TTL; got %v; wanted ErrBadTTL", err)
+    }
+    if ok, err := ms[0].PutTTL("a", "x", ttl); !ok || err != nil {
+        t.Fatalf("PutTTL failed; got %v, %v", ok, err)
+    }
+    ms[1].Put("b", "x")
+    ms[1].PutTTL("c", "x", ttl)
+    // A write without a TTL makes the key never expire
+    ms[2].Update("c", "y")
+
+    if ok, v, _ := ms[2].Get("a"); !ok || v != "x" {
+        t.Fatalf("key expired early")
+    }
+
+    time.Sleep(ttl + 5 * tickInterval)
+
+    for i := 0; i < 3; i++ {
+        if ok, _, _ := ms[i].Get("a"); ok {
+            t.Fatalf("key did not expire on replica %v", i)
+        }
+        if ok, _, _ := ms[i].Get("b"); !ok {
+            t.Fatalf("key without a TTL expired on replica %v", i)
+        }
+        if ok, v, _ := ms[i].Get("c"); !ok || v != "y" {
+            t.Fatalf("key updated without a TTL expired on replica %v", i)
+        }
+    }
+
+    // The Tick removed the expiry of the key on every replica
+    for i := 0; i < 3; i++ {
+        ms[i].lock.Lock()
+        n := len(ms[i].expires)
+        ms[i].lock.Unlock()
+        if n != 0 {
+            t.Fatalf("replica %v still has %v keys to expire", i, n)
+        }
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestProposed(t *testing.T) {
+    fmt.Printf("Test: Values decoded by gob match the proposal ...\n")
+
+    txn := Transaction{[]Check{}, []Mutation{{"Set", "a", "x"}}}
+    v := Batch{[]Proposal{
+        {"Transaction", "", "", 5, 0, 0, "", &txn, 0},
+        {"Put", "b", "y", 6, 0, 0, "", nil, 0},
+    }}
+
+    // As a competing proposer gets it from the acceptors
+    buf := bytes.Buffer{}
+    var decided interface{} = v
+    if err := gob.NewEncoder(&buf).Encode(&decided); err != nil {
+        t.Fatalf("Encode: %v", err)
+    }
+    decided = nil
+    if err := gob.NewDecoder(&buf).Decode(&decided); err != nil {
+        t.Fatalf("Decode: %v", err)
+    }
+
+    if !proposed(decided, v) {
+        t.Fatalf("decoded value does not match the proposal")
+    }
+    other := Batch{[]Proposal{{"Put", "b", "y", 7, 0, 0, "", nil, 0}}}
+    if proposed(other, v) || proposed(v.Ops[1], v) {
+        t.Fatalf("other value matches the proposal")
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestHoleFiller(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    ms := makeCluster(3)
+    defer cleanup(ms)
+    peers := ms[0].px.Configs()[0].Peers
+
+    fmt.Printf("Test: One proposer fills a hole in a minority ...\n")
+
+    for i := 0; i < 3; i++ {
+        ms[i].Faults().Partition("p", peers[:1], peers[1:])
+    }
+    // The hole at instance 0 cannot be filled without a majority
+    ms[0].px.Start(1, Proposal{"Put", "a", "x", 1, 0, 0, "", nil, 0})
+
+    time.Sleep(holeTimeout + holeTimeout / 2)
+    before := runtime.NumGoroutine()
+    time.Sleep(3 * holeTimeout)
+    if after := runtime.NumGoroutine(); after - before >= 2 {
+        t.Fatalf("proposers pile up on the hole; %v goroutines, %v before", after, before)
+    }
+
+    for i := 0; i < 3; i++ {
+        ms[i].Faults().Heal("p")
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestTimeout(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    const nops = 5
+    const timeout = 200 * time.Millisecond
+
+    ms := makeCluster(3)
+    defer cleanup(ms)
+    peers := ms[0].px.Configs()[0].Peers
+
+    fmt.Printf("Test: Operations in a minority time out ...\n")
+
+    for i := 0; i < 3; i++ {
+        ms[i].Faults().Partition("p", peers[:1], peers[1:])
+    }
+    ms[0].SetTimeout(timeout)
+
+    before := runtime.NumGoroutine()
+    for i := 0; i < nops; i++ {
+        start := time.Now()
+        if _, err := ms[0].Put("a", "x"); err != ErrTimeout {
+            t.Fatalf("Put in a minority returned %v; wanted ErrTimeout", err)
+        }
+        if d := time.Since(start); d > 5 * timeout {
+            t.Fatalf("Put gave up after %v; timeout %v", d, timeout)
+        }
+    }
+    // The proposers of the operations given up exit
+    time.Sleep(2 * timeout)
+    if after := runtime.NumGoroutine(); after - before >= nops {
+        t.Fatalf("proposers left running; %v goroutines, %v before", after, before)
+    }
+
+    for i := 0; i < 3; i++ {
+        ms[i].Faults().Heal("p")
+    }
+    ms[0].SetTimeout(0)
+    if ok, err := ms[0].Put("b", "y"); !ok || err != nil {
+        t.Fatalf("Put after healing returned %v, %v", ok, err)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestBadSnapshot(t *testing.T) {
+    ms := makeCluster(1)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: A snapshot that cannot be decoded is reported ...\n")
+
+    m := ms[0]
+    m.lock.Lock()
+    done := m.done
+    err := m.installSnapshot(done + 10, []byte("not a snapshot"))
+    moved := m.done != done
+    m.lock.Unlock()
+    if err != ErrBadSnapshot {
+        t.Fatalf("bad snapshot installed; got %v; wanted ErrBadSnapshot", err)
+    }
+    if moved {
+        t.Fatalf("bad snapshot moved the applied instances")
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestCoveredTick(t *testing.T) {
+    ms := makeCluster(1)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: A Tick covered by a snapshot does not run again ...\n")
+
+    m := ms[0]
+    m.lock.Lock()
+    // Expired, but not removed by a Tick yet
+    m.now = 100
+    m.set("a", "x", 50)
+    _, decided, err := m.covered(0, Proposal{"Tick", "", "", 1, 0, 0, "", nil, 200})
+    _, exist := m.data["a"]
+    m.lock.Unlock()
+    if !decided || err != nil {
+        t.Fatalf("covered Tick; got %v, %v", decided, err)
+    }
+    if !exist {
+        t.Fatalf("covered Tick removed a key outside the log")
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestCoveredRead(t *testing.T) {
+    ms := makeCluster(1)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: A read covered by a snapshot is proposed again ...\n")
+
+    m := ms[0]
+    m.lock.Lock()
+    m.set("a", "x", 0)
+    m.results[1] = result{0, true, "", 0}
+    b := Batch{[]Proposal{
+        Proposal{"Put", "b", "y", 1, 0, 0, "", nil, 0},
+        Proposal{"Get", "a", "", 2, 0, 0, "", nil, 0},
+    }}
+    _, decided, err := m.covered(0, b)
+    // The write of the batch proposed again takes effect once
+    rs := m.apply(b)
+    _, exist := m.data["b"]
+    m.lock.Unlock()
+    if decided || err != nil {
+        t.Fatalf("covered read; got %v, %v; wanted not decided", decided, err)
+    }
+    if exist {
+        t.Fatalf("write applied twice")
+    }
+    if !rs[1].Ok || rs[1].Value != "x" {
+        t.Fatalf("read proposed again; got %v", rs[1])
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestCoveredReconfig(t *testing.T) {
+    ms := makeCluster(1)
+    defer cleanup(ms)
+
+    fmt.Printf("Test: A Reconfig covered by a snapshot is decided once it is in the configs ...\n")
+
+    m := ms[0]
+    peers := m.px.Configs()[0].Peers
+    if err := m.Reconfigure(peers); err != nil {
+        t.Fatalf("Reconfigure failed; got %v", err)
+    }
+    configs := m.px.Configs()
+    seq := configs[len(configs) - 1].Start - configWindow
+
+    m.lock.Lock()
+    _, decided, err := m.covered(seq, paxos.Reconfig{Peers: peers})
+    _, later, _ := m.covered(seq + configWindow, paxos.Reconfig{Peers: peers})
+    _, other, _ := m.covered(seq, paxos.Reconfig{Peers: append([]string{""}, peers...)})
+    m.lock.Unlock()
+    if !decided || err != nil {
+        t.Fatalf("covered Reconfig; got %v, %v; wanted decided", decided, err)
+    }
+    if later {
+        t.Fatalf("Reconfig decided before its instance taken as decided")
+    }
+    if other {
+        t.Fatalf("Reconfig to other peers taken as decided")
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,206 @@
+package linearizability
+
+import (
+    "sort"
+)
+
+// Linearizability checker
+// The history of every key is checked on its own, with the algorithm of
+// Wing & Gong as improved by Lowe: operations are linearized one by one in
+// a depth-first search, and the pairs (linearized set, state) already
+// explored are cached.
+
+// The value of one key
+type state struct {
+    present bool
+    value string
+}
+
+// Apply in to s, and tell whether the output out is possible
+func step(s state, in Input, out Output, unknown bool) (bool, state) {
+    switch in.Type {
+    case "Put":
+        if !s.present {
+            return unknown || out.Ok, state{true, in.Value}
+        }
+        return unknown || !out.Ok, s
+    case "Get":
+        if unknown {
+            return true, s
+        }
+        return out.Ok == s.present && (!s.present || out.Value == s.value), s
+    case "Update":
+        if s.present {
+            return unknown || out.Ok, state{true, in.Value}
+        }
+        return unknown || !out.Ok, s
+    case "Delete":
+        if s.present {
+            return unknown || (out.Ok && out.Value == s.value), state{}
+        }
+        return unknown || !out.Ok, s
+    case "CompareAndSwap":
+        if s.present && s.value == in.Expected {
+            return unknown || (out.Ok && out.Value == s.value), state{true, in.Value}
+        }
+        return unknown || (!out.Ok && out.Value == s.value), s
+    }
+    return false, s
+}
+
+// Check the operations of a history, all keys starting absent
+// Returns false and the key whose history is not linearizable
+func Check(ops []Operation) (bool, string) {
+    keys := make(map[string][]Operation)
+    for _, op := range ops {
+        keys[op.Input.Key] = append(keys[op.Input.Key], op)
+    }
+
+    names := make([]string, 0, len(keys))
+    for key, _ := range keys {
+        names = append(names, key)
+    }
+    sort.Strings(names)
+    for _, key := range names {
+        if !checkKey(keys[key]) {
+            return false, key
+        }
+    }
+    return true, ""
+}
+
+//--------------------------------------------------//
+
+// The call and return events in a doubly linked list
+
+type entry struct {
+    call bool
+    id int
+    time int64
+    match *entry    // the return of a call
+    prev *entry
+    next *entry
+}
+
+func makeEntries(ops []Operation) *entry {
+    events := make([]*entry, 0, 2 * len(ops))
+    for id, op := range ops {
+        ret := &entry{false, id, op.Return, nil, nil, nil}
+        events = append(events, &entry{true, id, op.Call, ret, nil, nil}, ret)
+    }
+    sort.SliceStable(events, func(i, j int) bool {
+        if events[i].time != events[j].time {
+            return events[i].time < events[j].time
+        }
+        return events[i].call && !events[j].call
+    })
+
+    head := &entry{}
+    last := head
+    for _, e := range events {
+        last.next = e
+        e.prev = last
+        last = e
+    }
+    return head
+}
+
+// Take a call and its return out of the list
+func lift(e *entry) {
+    e.prev.next = e.next
+    e.next.prev = e.prev
+    r := e.match
+    r.prev.next = r.next
+    if r.next != nil {
+        r.next.prev = r.prev
+    }
+}
+
+// Put them back
+func unlift(e *entry) {
+    r := e.match
+    r.prev.next = r
+    if r.next != nil {
+        r.next.prev = r
+    }
+    e.prev.next = e
+    e.next.prev = e
+}
+
+//--------------------------------------------------//
+
+// Sets of linearized operations
+
+type bitset []uint64
+
+func (b bitset) set(i int) bitset {
+    c := make(bitset, len(b))
+    copy(c, b)
+    c[i / 64] |= 1 << uint(i % 64)
+    return c
+}
+
+func (b bitset) key() string {
+    buf := make([]byte, 0, 8 * len(b))
+    for _, w := range b {
+        for i := uint(0); i < 64; i += 8 {
+            buf = append(buf, byte(w >> i))
+        }
+    }
+    return string(buf)
+}
+
+type frame struct {
+    e *entry
+    s state
+    linearized bitset
+}
+
+func checkKey(ops []Operation) bool {
+    head := makeEntries(ops)
+    s := state{}
+    linearized := make(bitset, (len(ops) + 63) / 64)
+    cache := make(map[string][]state)
+    stack := make([]frame, 0)
+
+    e := head.next
+    for head.next != nil {
+        if e.call {
+            op := ops[e.id]
+            ok, next := step(s, op.Input, op.Output, op.Unknown)
+            if ok {
+                l := linearized.set(e.id)
+                k := l.key()
+                seen := false
+                for _, s1 := range cache[k] {
+                    if s1 == next {
+                        seen = true
+                        break
+                    }
+                }
+                if !seen {
+                    cache[k] = append(cache[k], next)
+                    stack = append(stack, frame{e, s, linearized})
+                    s = next
+                    linearized = l
+                    lift(e)
+                    e = head.next
+                    continue
+                }
+            }
+            e = e.next
+        } else {
+            // The operation returned before any order could linearize it
+            if len(stack) == 0 {
+                return false
+            }
+            f := stack[len(stack) - 1]
+            stack = stack[:len(stack) - 1]
+            s = f.s
+            linearized = f.linearized
+            unlift(f.e)
+            e = f.e.next
+        }
+    }
+    return true
+}
@@ -0,0 +1,86 @@
+package linearizability
+
+import (
+    "math"
+    "sync"
+)
+
+// History of the operations of concurrent clients
+// Call and Return are stamped with one logical clock, so that the order of
+// the events is the order in which they were recorded.
+
+type Input struct {
+    Type string     // "Put", "Get", "Update", "Delete" or "CompareAndSwap"
+    Key string
+    Value string
+    Expected string // for CompareAndSwap
+}
+
+type Output struct {
+    Ok bool
+    Value string
+}
+
+type Operation struct {
+    Client int
+    Input Input
+    Output Output
+    Call int64
+    Return int64
+    Unknown bool    // the operation failed, and may or may not take effect
+}
+
+type History struct {
+    ops []Operation
+    clock int64
+    lock sync.Mutex
+}
+
+func NewHistory() *History {
+    return &History{}
+}
+
+// Record the call of an operation, and return its id
+func (h *History) Call(client int, in Input) int {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    h.clock++
+    h.ops = append(h.ops, Operation{client, in, Output{}, h.clock, 0, false})
+    return len(h.ops) - 1
+}
+
+func (h *History) Return(id int, out Output) {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    h.clock++
+    h.ops[id].Output = out
+    h.ops[id].Return = h.clock
+}
+
+// The operation returned without knowing whether it took effect
+func (h *History) Fail(id int) {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    h.ops[id].Unknown = true
+    h.ops[id].Return = math.MaxInt64
+}
+
+// The operations recorded so far
+// Operations that have not returned yet are unknown
+func (h *History) Operations() []Operation {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    ops := make([]Operation, len(h.ops))
+    copy(ops, h.ops)
+    for i := 0; i < len(ops); i++ {
+        if ops[i].Return == 0 {
+            ops[i].Unknown = true
+            ops[i].Return = math.MaxInt64
+        }
+    }
+    return ops
+}
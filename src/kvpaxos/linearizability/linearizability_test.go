@@ -0,0 +1,66 @@
+package linearizability
+
+import "testing"
+import "fmt"
+
+func TestCheck(t *testing.T) {
+    fmt.Printf("Test: Linearizable histories ...\n")
+
+    h := NewHistory()
+    a := h.Call(0, Input{"Put", "k", "1", ""})
+    b := h.Call(1, Input{"Get", "k", "", ""})
+    h.Return(a, Output{true, ""})
+    c := h.Call(0, Input{"Update", "k", "2", ""})
+    h.Return(b, Output{false, ""})  // linearized before a
+    h.Return(c, Output{true, ""})
+    d := h.Call(1, Input{"Delete", "k", "", ""})
+    h.Return(d, Output{true, "2"})
+    e := h.Call(2, Input{"Put", "j", "x", ""})
+    h.Fail(e)
+    f := h.Call(2, Input{"Get", "j", "", ""})
+    h.Return(f, Output{true, "x"})  // e took effect
+    g := h.Call(0, Input{"CompareAndSwap", "j", "y", "x"})
+    h.Return(g, Output{true, "x"})
+    i := h.Call(1, Input{"CompareAndSwap", "j", "z", "x"})
+    h.Return(i, Output{false, "y"})
+
+    if ok, key := Check(h.Operations()); !ok {
+        t.Fatalf("history of %v should be linearizable", key)
+    }
+
+    fmt.Printf("  ... Passed\n")
+
+    fmt.Printf("Test: Histories that are not linearizable ...\n")
+
+    h = NewHistory()
+    a = h.Call(0, Input{"Put", "k", "1", ""})
+    h.Return(a, Output{true, ""})
+    b = h.Call(1, Input{"Get", "k", "", ""})
+    h.Return(b, Output{false, ""})  // a returned before b was called
+
+    if ok, _ := Check(h.Operations()); ok {
+        t.Fatalf("stale read accepted")
+    }
+
+    h = NewHistory()
+    a = h.Call(0, Input{"Put", "k", "1", ""})
+    b = h.Call(1, Input{"Put", "k", "2", ""})
+    h.Return(a, Output{true, ""})
+    h.Return(b, Output{true, ""})   // only one insert can succeed
+
+    if ok, _ := Check(h.Operations()); ok {
+        t.Fatalf("two inserts accepted")
+    }
+
+    h = NewHistory()
+    a = h.Call(0, Input{"Put", "k", "1", ""})
+    h.Return(a, Output{true, ""})
+    b = h.Call(1, Input{"CompareAndSwap", "k", "2", "0"})
+    h.Return(b, Output{true, "1"})  // the value is not the expected one
+
+    if ok, _ := Check(h.Operations()); ok {
+        t.Fatalf("wrong swap accepted")
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,59 @@
+package kvpaxos
+
+// Client sessions
+// A client numbers its operations 1, 2, 3, ... and waits for each one before
+// the next. Every replica keeps the last operation of each client and its
+// result, so that a retried operation returns the same result instead of
+// taking effect again.
+// A session idle for sessionWindow instances is dropped at the next
+// snapshot, at the same instance on every replica. An operation of the
+// client retried after that takes effect again.
+
+// The instances a session is kept after its last operation
+const sessionWindow = 10 * snapshotInterval
+
+// The zero Session is no session
+type Session struct {
+    Client int64
+    Seq int
+}
+
+type session struct {
+    Seq int
+    Result result
+}
+
+// Must acquire m.lock
+// The result of p, if its session already applied it
+// An operation older than the last one gets a failure, as its client no
+// longer waits for it.
+func (m *KVPaxosMap) replied(p Proposal) (result, bool) {
+    if p.Client == 0 {
+        return result{}, false
+    }
+    s, exist := m.sessions[p.Client]
+    if !exist || p.Seq > s.Seq {
+        return result{}, false
+    }
+    if p.Seq < s.Seq {
+        return result{m.done, false, "", 0}, true
+    }
+    return s.Result, true
+}
+
+// Must acquire m.lock
+func (m *KVPaxosMap) remember(p Proposal, r result) {
+    if p.Client != 0 {
+        m.sessions[p.Client] = session{p.Seq, r}
+    }
+}
+
+// Must acquire m.lock
+// Drop the sessions idle since before instance seq
+func (m *KVPaxosMap) pruneSessions(seq int) {
+    for client, s := range m.sessions {
+        if s.Result.Seq < seq {
+            delete(m.sessions, client)
+        }
+    }
+}
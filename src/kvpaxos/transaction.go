@@ -0,0 +1,57 @@
+package kvpaxos
+
+import (
+    "errors"
+)
+
+// Transactions
+// A transaction is decided in one instance as a single operation, and its
+// mutations are applied together only if all its checks hold.
+
+var ErrBadTransaction = errors.New("transaction with an unknown mutation")
+
+// The key is present with Value, or absent if Present is false
+type Check struct {
+    Key string
+    Present bool
+    Value string
+}
+
+// Type is "Set", which writes the key present or not, or "Delete"
+type Mutation struct {
+    Type string
+    Key string
+    Value string
+}
+
+type Transaction struct {
+    Checks []Check
+    Mutations []Mutation
+}
+
+func (t Transaction) valid() bool {
+    for _, mu := range t.Mutations {
+        if mu.Type != "Set" && mu.Type != "Delete" {
+            return false
+        }
+    }
+    return true
+}
+
+// Must acquire m.lock
+func (m *KVPaxosMap) transact(t Transaction) bool {
+    for _, c := range t.Checks {
+        value, ok := m.data[c.Key]
+        if ok != c.Present || (ok && value != c.Value) {
+            return false
+        }
+    }
+    for _, mu := range t.Mutations {
+        if mu.Type == "Set" {
+            m.set(mu.Key, mu.Value, 0)
+        } else if mu.Type == "Delete" {
+            m.remove(mu.Key)
+        }
+    }
+    return true
+}
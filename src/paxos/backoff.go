@@ -0,0 +1,47 @@
+package paxos
+
+import (
+    "paxos/paxosutility"
+
+    "fmt"
+    "hash/fnv"
+    "time"
+)
+
+// Backoff between the rounds of a proposer
+// Every failed round doubles the wait. The wait is jittered so that
+// duelling proposers fall out of step, and the proposer with the highest
+// ballot seen waits the shorter half, so that it finishes first.
+// The jitter only depends on the peer, the instance and the round, so a
+// simulation is reproduced from its seed.
+
+const minBackoff = 10 * time.Millisecond
+const maxBackoff = 1 * time.Second
+
+type backoff struct {
+    px *Paxos
+    seq int
+    wait time.Duration
+}
+
+func (px *Paxos) newBackoff(seq int) *backoff {
+    return &backoff{px, seq, minBackoff}
+}
+
+// Wait after the round n failed, with np the highest ballot seen
+func (b *backoff) sleep(n paxosutility.Ballot, np paxosutility.Ballot) {
+    h := fnv.New64a()
+    fmt.Fprintf(h, "%d|%d|%d", b.px.me, b.seq, n.Round)
+    half := int64(b.wait / 2)
+    d := time.Duration(int64(h.Sum64() >> 1) % (half + 1))
+    if n.Less(np) {
+        // Another proposer is ahead, let it finish
+        d += time.Duration(half)
+    }
+
+    b.wait *= 2
+    if b.wait > maxBackoff {
+        b.wait = maxBackoff
+    }
+    b.px.sleep(d)
+}
@@ -0,0 +1,60 @@
+package paxos
+
+import (
+    "time"
+)
+
+// Clock runs the goroutines of a peer and makes them wait
+// The real clock uses the Go runtime; the simulation in sim.go runs every
+// peer on a virtual clock.
+
+type Clock interface {
+    Now() time.Time
+    Sleep(d time.Duration)
+    // Run f in a new goroutine
+    Go(f func())
+    // A queue of up to n values between goroutines
+    Mailbox(n int) Mailbox
+}
+
+type Mailbox interface {
+    Put(v interface{})
+    // Wait for a value
+    Get() interface{}
+}
+
+func (px *Paxos) SetClock(clock Clock) {
+    px.clock = clock
+}
+
+//--------------------------------------------------//
+
+// Real clock
+
+type realClock struct{}
+
+func (c realClock) Now() time.Time {
+    return time.Now()
+}
+
+func (c realClock) Sleep(d time.Duration) {
+    time.Sleep(d)
+}
+
+func (c realClock) Go(f func()) {
+    go f()
+}
+
+func (c realClock) Mailbox(n int) Mailbox {
+    return chanMailbox(make(chan interface{}, n))
+}
+
+type chanMailbox chan interface{}
+
+func (mb chanMailbox) Put(v interface{}) {
+    mb <- v
+}
+
+func (mb chanMailbox) Get() interface{} {
+    return <-mb
+}
@@ -0,0 +1,160 @@
+package paxos
+
+import (
+    "paxos/paxosutility"
+
+    "encoding/gob"
+    "sort"
+)
+
+// Membership changes
+//
+// Every peer has a slot, its index into peers. A slot is never reused, and
+// "" marks a slot that is out of the group.
+// A Reconfig value decided in instance s is the configuration of every
+// instance from s + window on, so a peer has to know every instance up to
+// seq - window before it proposes instance seq.
+// Not available in leader mode.
+
+const maxPeers = 100
+
+// The value to propose to change the group
+type Reconfig struct {
+    Peers []string
+}
+
+// The configuration of the instances from Start on
+type Config struct {
+    Start int
+    Peers []string
+}
+
+func init() {
+    gob.Register(Reconfig{})
+}
+
+// Returns the configurations known to this peer
+func (px *Paxos) Configs() []Config {
+    px.configlock.Lock()
+    defer px.configlock.Unlock()
+
+    configs := make([]Config, len(px.configs))
+    copy(configs, px.configs)
+    return configs
+}
+
+//--------------------------------------------------//
+
+// Maintain the configurations
+
+// The address of slot i
+func (px *Paxos) address(i int) string {
+    px.configlock.Lock()
+    defer px.configlock.Unlock()
+
+    return px.peers[i]
+}
+
+// The configuration of instance seq, with configlock held
+func (px *Paxos) config(seq int) Config {
+    i := sort.Search(len(px.configs), func(i int) bool {
+        return px.configs[i].Start > seq
+    })
+    return px.configs[i - 1]
+}
+
+// The slots of the members in the configuration of instance seq
+func (px *Paxos) members(seq int) []int {
+    px.configlock.Lock()
+    defer px.configlock.Unlock()
+
+    return slots(px.config(seq).Peers)
+}
+
+// The slots of the members of the latest configuration, with minlock held
+func (px *Paxos) current() []int {
+    px.configlock.Lock()
+    defer px.configlock.Unlock()
+
+    return slots(px.configs[len(px.configs) - 1].Peers)
+}
+
+func slots(peers []string) []int {
+    result := make([]int, 0, len(peers))
+    for i, peer := range peers {
+        if peer != "" {
+            result = append(result, i)
+        }
+    }
+    return result
+}
+
+// Add a configuration, and learn the addresses of new slots
+// Invalid configurations are ignored by every peer in the same way
+func (px *Paxos) addConfig(config Config, persist bool) {
+    if len(slots(config.Peers)) == 0 || len(config.Peers) > maxPeers {
+        return
+    }
+
+    px.configlock.Lock()
+    i := sort.Search(len(px.configs), func(i int) bool {
+        return px.configs[i].Start >= config.Start
+    })
+    if i < len(px.configs) && px.configs[i].Start == config.Start {
+        px.configlock.Unlock()
+        return
+    }
+    px.configs = append(px.configs, Config{})
+    copy(px.configs[i + 1:], px.configs[i:])
+    px.configs[i] = config
+    for len(px.peers) < len(config.Peers) {
+        px.peers = append(px.peers, "")
+    }
+    for slot, peer := range config.Peers {
+        if peer != "" {
+            px.peers[slot] = peer
+        }
+    }
+    total := len(px.peers)
+    px.configlock.Unlock()
+
+    if persist {
+        px.persist(paxosutility.LogRecord{Type: paxosutility.RecordConfig, Seq: config.Start, Va: config.Peers}, false)
+    }
+
+    // Track the Done of the new slots, and forget without the removed ones
+    px.minlock.Lock()
+    for len(px.min) < total {
+        px.min = append(px.min, -1)
+    }
+    px.forget()
+    px.minlock.Unlock()
+}
+
+// Learn the configuration decided in instance seq
+func (px *Paxos) learnConfig(seq int, v interface{}) {
+    if r, ok := v.(Reconfig); ok && px.window > 0 {
+        px.addConfig(Config{seq + px.window, r.Peers}, true)
+    }
+}
+
+// Wait until every instance up to seq - window is known, so that the
+// configuration of instance seq is known
+// Returns false if the peer is killed
+func (px *Paxos) waitConfig(seq int) bool {
+    px.learnlock.Lock()
+    defer px.learnlock.Unlock()
+
+    for px.known < seq - px.window {
+        if px.isdead() {
+            return false
+        }
+        next := px.known + 1
+        if exist, _ := px.result.Read(next); exist || next <= px.snapshot.Seq || next < px.Min() {
+            px.known = next
+            continue
+        }
+        px.learnCond.Wait()
+    }
+    return true
+}
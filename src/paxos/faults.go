@@ -0,0 +1,180 @@
+package paxos
+
+import (
+    "context"
+    "math/rand"
+    "net"
+    "sync"
+    "time"
+)
+
+// Fault injection
+// Faults wraps the transports of the peers, and drops, delays and reorders
+// the RPCs they send. Partitions are named, so that they can be healed one
+// by one. Everything can be changed while the peers are running.
+
+type Faults struct {
+    drop float64        // probability that a request is lost
+    dropReply float64   // probability that a reply is lost after the request is handled
+    delay time.Duration // every RPC is delayed by up to delay
+    reorder float64     // probability that an RPC is held back for up to hold
+    hold time.Duration
+    partitions map[string][][]string
+    rand *rand.Rand
+    lock sync.Mutex
+}
+
+func NewFaults() *Faults {
+    f := &Faults{}
+    f.partitions = make(map[string][][]string)
+    f.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+    return f
+}
+
+func (f *Faults) SetDrop(p float64) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.drop = p
+}
+
+func (f *Faults) SetDropReply(p float64) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.dropReply = p
+}
+
+func (f *Faults) SetDelay(delay time.Duration) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.delay = delay
+}
+
+// Later RPCs overtake the ones held back
+func (f *Faults) SetReorder(p float64, hold time.Duration) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.reorder = p
+    f.hold = hold
+}
+
+// Peers in different groups of a partition cannot talk to each other
+// Peers in no group are not affected by it
+func (f *Faults) Partition(name string, groups ...[]string) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.partitions[name] = groups
+}
+
+func (f *Faults) Heal(name string) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    delete(f.partitions, name)
+}
+
+// Remove every fault
+func (f *Faults) Reset() {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.drop = 0
+    f.dropReply = 0
+    f.delay = 0
+    f.reorder = 0
+    f.partitions = make(map[string][][]string)
+}
+
+// The transport of the peer at self, sending through tr
+func (f *Faults) Transport(self string, tr Transport) Transport {
+    return &faultyTransport{f, self, tr}
+}
+
+//--------------------------------------------------//
+
+// Decide the fate of one RPC
+
+func group(groups [][]string, addr string) int {
+    for i, g := range groups {
+        for _, a := range g {
+            if a == addr {
+                return i
+            }
+        }
+    }
+    return -1
+}
+
+func (f *Faults) blocked(src string, dst string) bool {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    for _, groups := range f.partitions {
+        g1 := group(groups, src)
+        g2 := group(groups, dst)
+        if g1 >= 0 && g2 >= 0 && g1 != g2 {
+            return true
+        }
+    }
+    return false
+}
+
+func (f *Faults) replyLost() bool {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    return f.dropReply > 0 && f.rand.Float64() < f.dropReply
+}
+
+// How long an RPC waits before it is sent, and whether it is lost
+func (f *Faults) request() (time.Duration, bool) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    wait := time.Duration(0)
+    if f.delay > 0 {
+        wait = time.Duration(f.rand.Int63n(int64(f.delay)))
+    }
+    if f.hold > 0 && f.rand.Float64() < f.reorder {
+        wait += time.Duration(f.rand.Int63n(int64(f.hold)))
+    }
+    return wait, f.drop > 0 && f.rand.Float64() < f.drop
+}
+
+type faultyTransport struct {
+    f *Faults
+    self string
+    tr Transport
+}
+
+func (ft *faultyTransport) Listen(addr string) (net.Listener, error) {
+    return ft.tr.Listen(addr)
+}
+
+func (ft *faultyTransport) Call(ctx context.Context, srv string, name string, args interface{}, reply interface{}) bool {
+    if ft.f.blocked(ft.self, srv) {
+        return false
+    }
+    wait, lost := ft.f.request()
+    select {
+    case <-time.After(wait):
+    case <-ctx.Done():
+        return false
+    }
+    if lost || ft.f.blocked(ft.self, srv) {
+        return false
+    }
+
+    if !ft.tr.Call(ctx, srv, name, args, reply) {
+        return false
+    }
+    return !ft.f.replyLost()
+}
+
+func (ft *faultyTransport) Close() {
+    ft.tr.Close()
+}
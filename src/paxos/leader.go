@@ -0,0 +1,346 @@
+package paxos
+
+import (
+    "paxos/paxosutility"
+
+    "context"
+    "time"
+)
+
+// Multi-Paxos
+//
+// In leader mode one peer wins a ballot for every instance at once with
+// HandleLead, and then proposes new instances with HandleAccept only.
+// Other peers forward their proposals to the leader, and try to take over
+// if the leader does not decide them in time.
+// All peers of a group must use the same mode.
+
+const leaderTimeout = 1 * time.Second
+
+func (px *Paxos) SetLeaderMode(on bool) {
+    px.leaderMode = on
+}
+
+//--------------------------------------------------//
+
+// Maintain the leadership
+
+// The leader known to this peer, or -1
+func (px *Paxos) leader() int {
+    px.ballotlock.RLock()
+    defer px.ballotlock.RUnlock()
+
+    if px.ballot.IsZero() {
+        return -1
+    }
+    return px.ballot.NodeID
+}
+
+// The highest ballot seen from any leader
+func (px *Paxos) highestBallot() paxosutility.Ballot {
+    px.ballotlock.RLock()
+    defer px.ballotlock.RUnlock()
+
+    return px.ballot
+}
+
+// Returns the ballot of this peer and whether it is the leader
+func (px *Paxos) leadership() (paxosutility.Ballot, bool) {
+    px.leaderlock.Lock()
+    defer px.leaderlock.Unlock()
+
+    return px.leadBallot, px.leading
+}
+
+// Give up the leadership won with a ballot lower than n
+func (px *Paxos) stepDown(n paxosutility.Ballot) {
+    px.leaderlock.Lock()
+    defer px.leaderlock.Unlock()
+
+    if px.leadBallot.Less(n) {
+        px.leading = false
+    }
+}
+
+// The value the leader must propose in instance seq
+// A ballot carries one value per instance, so the first value proposed in
+// seq is kept for the later proposers of seq, such as a forwarded one.
+func (px *Paxos) leadValue(seq int, v interface{}) interface{} {
+    px.leaderlock.Lock()
+    defer px.leaderlock.Unlock()
+
+    if va, exist := px.leadValues[seq]; exist {
+        return va
+    }
+    px.leadValues[seq] = v
+    return v
+}
+
+// Drop the values of the instances <= bound
+func (px *Paxos) forgetLeadValues(bound int) {
+    px.leaderlock.Lock()
+    defer px.leaderlock.Unlock()
+
+    for seq, _ := range px.leadValues {
+        if seq <= bound {
+            delete(px.leadValues, seq)
+        }
+    }
+}
+
+//--------------------------------------------------//
+
+// HandleLead RPC
+// Promise n for every instance, and report what was accepted before
+
+type Instance struct {
+    Seq int
+    Decided bool
+    Na paxosutility.Ballot
+    Va interface{}
+}
+
+type LeadArgs struct {
+    N paxosutility.Ballot
+    Doneseq int
+    Index int
+}
+
+type LeadReplys struct {
+    Doneseq int
+    Ok bool
+    Ballot paxosutility.Ballot  // the highest ballot this peer knows of
+    Accepted []Instance
+}
+
+func (px *Paxos) HandleLead(args LeadArgs, replys *LeadReplys) error {
+    if px.isdead() {
+        return nil
+    }
+
+    px.refreshMin(args.Doneseq, args.Index)
+
+    replys.Doneseq = px.getMin(px.me)
+
+    px.ballotlock.Lock()
+    defer px.ballotlock.Unlock()
+
+    replys.Ballot = px.ballot
+    if !px.ballot.Less(args.N) {
+        replys.Ok = false
+        return nil
+    }
+
+    ok := true
+    accepted := make([]Instance, 0)
+    px.result.Range(func(seq int, v interface{}) {
+        accepted = append(accepted, Instance{seq, true, paxosutility.Ballot{}, v})
+    })
+    px.alloc.Range(func(seq int, data *paxosutility.PaxosData) {
+        data.Lock.Lock()
+        defer data.Lock.Unlock()
+
+        if exist, _ := px.result.Read(seq); exist {
+            return
+        }
+        if np, _ := data.Np.Load().(paxosutility.Ballot); !np.Less(args.N) {
+            ok = false
+            if replys.Ballot.Less(np) {
+                replys.Ballot = np
+            }
+        }
+        if na, _ := data.Na.Load().(paxosutility.Ballot); !na.IsZero() {
+            accepted = append(accepted, Instance{seq, false, na, data.Va.Load()})
+        }
+    })
+    if !ok {
+        replys.Ok = false
+        return nil
+    }
+
+    px.ballot = args.N
+    // The promise must be on disk before it is sent
+    replys.Ok = px.persist(paxosutility.LogRecord{Type: paxosutility.RecordBallot, Np: args.N}, true)
+    replys.Accepted = accepted
+
+    // A new leader takes over
+    px.stepDown(args.N)
+    return nil
+}
+
+//--------------------------------------------------//
+
+// HandleForward RPC
+// A non-leader hands a proposal to the leader
+
+type ForwardArgs struct {
+    Seq int
+    V interface{}
+}
+
+type ForwardReplys struct {
+    Ok bool
+}
+
+func (px *Paxos) HandleForward(args ForwardArgs, replys *ForwardReplys) error {
+    if px.isdead() {
+        return nil
+    }
+
+    _, replys.Ok = px.leadership()
+    if replys.Ok {
+        px.Start(args.Seq, args.V)
+    }
+    return nil
+}
+
+//--------------------------------------------------//
+
+// Try to become the leader with a ballot larger than every one seen
+// Returns whether this peer is the leader now
+func (px *Paxos) campaign(ctx context.Context) bool {
+    px.ballotlock.RLock()
+    n := px.ballot
+    px.ballotlock.RUnlock()
+    px.leaderlock.Lock()
+    if n.Less(px.leadSeen) {
+        n = px.leadSeen
+    }
+    px.leaderlock.Unlock()
+    n = n.Next(px.me)
+
+    args := LeadArgs{n, px.getMin(px.me), px.me}
+    mb := px.clock.Mailbox(px.total)
+    for i := 0; i < px.total; i++ {
+        i := i
+        px.spawn(func() {
+            replys := &LeadReplys{}
+            if i != px.me {
+                if !px.call(ctx, i, "Paxos.HandleLead", args, replys) {
+                    mb.Put(nil)
+                    return
+                }
+            } else {
+                px.HandleLead(args, replys)
+            }
+            px.refreshMin(replys.Doneseq, i)
+            mb.Put(replys)
+        })
+    }
+
+    // Wait until the majority is reached or becomes impossible
+    success := 0
+    failure := 0
+    na := make(map[int]paxosutility.Ballot)
+    values := make(map[int]interface{})
+    decided := make(map[int]interface{})
+    for success + success <= px.total && failure + failure < px.total {
+        replys, _ := mb.Get().(*LeadReplys)
+        if px.isdead() {
+            return false
+        }
+
+        if replys == nil || !replys.Ok {
+            failure++
+            if replys != nil {
+                px.leaderlock.Lock()
+                if px.leadSeen.Less(replys.Ballot) {
+                    px.leadSeen = replys.Ballot
+                }
+                px.leaderlock.Unlock()
+            }
+            continue
+        }
+        success++
+
+        // Keep the value accepted with the highest ballot of each instance
+        for _, inst := range replys.Accepted {
+            if inst.Decided {
+                decided[inst.Seq] = inst.Va
+            } else if old, exist := na[inst.Seq]; !exist || old.Less(inst.Na) {
+                na[inst.Seq] = inst.Na
+                values[inst.Seq] = inst.Va
+            }
+        }
+    }
+
+    if success + success <= px.total {
+        return false
+    }
+
+    px.leaderlock.Lock()
+    if px.leadBallot.Less(n) {
+        px.leading = true
+        px.leadBallot = n
+        px.leadValues = values
+    }
+    px.leaderlock.Unlock()
+
+    // Finish the instances left by the previous leader
+    for seq, v := range decided {
+        px.decide(seq, v)
+    }
+    for seq, v := range values {
+        if _, exist := decided[seq]; !exist && seq >= px.Min() {
+            seq, v := seq, v
+            px.spawn(func() { px.propose(px.ctx, seq, v) })
+        }
+    }
+    return true
+}
+
+// Hand the proposal to the leader, and wait for it to be decided
+// Returns false if the leader is unknown or does not decide in time
+func (px *Paxos) forward(ctx context.Context, seq int, v interface{}) bool {
+    leader := px.leader()
+    if leader < 0 || leader == px.me {
+        return false
+    }
+
+    replys := &ForwardReplys{}
+    if !px.call(ctx, leader, "Paxos.HandleForward", ForwardArgs{seq, v}, replys) || !replys.Ok {
+        return false
+    }
+
+    for to := time.Duration(0); to < leaderTimeout && ctx.Err() == nil; to += 10 * time.Millisecond {
+        if exist, _ := px.result.Read(seq); exist {
+            return true
+        }
+        px.sleep(10 * time.Millisecond)
+    }
+    return false
+}
+
+func (px *Paxos) proposeLeader(ctx context.Context, seq int, v interface{}) {
+    b := px.newBackoff(seq)
+    for ctx.Err() == nil {
+        // If the instance is already abandoned, then break
+        if seq < px.Min() {
+            return
+        }
+
+        // If the instance already decides, then break
+        if exist, _ := px.result.Read(seq); exist {
+            return
+        }
+
+        if n, leading := px.leadership(); leading {
+            // The leader skips the prepare phase
+            va := px.leadValue(seq, v)
+            if ok, _ := px.sendAccept(ctx, seq, n, va); ok {
+                px.decide(seq, va)
+                return
+            }
+            if exist, _ := px.result.Read(seq); !exist {
+                px.stepDown(n.Next(px.me))
+            }
+        } else if px.forward(ctx, seq, v) {
+            continue
+        } else if px.campaign(ctx) {
+            continue
+        }
+
+        n, _ := px.leadership()
+        b.sleep(n, px.highestBallot())
+    }
+}
@@ -3,38 +3,85 @@ package paxos
 import (
     "paxos/paxosutility"
 
+    "bufio"
     "container/list"
+    "context"
+    "encoding/gob"
+    "errors"
     "net"
     "net/rpc"
     "log"
     "sync"
-    "syscall"
+    "sync/atomic"
     "fmt"
     "math/rand"
+    "sort"
+    "strconv"
     "time"
 )
 
 type Paxos struct {
     l net.Listener
-    dead bool
-    unreliable bool
-    rpcCount int
+    dead int32
+    unreliable int32
+    rpcCount int64
+    transport Transport
+    rpcTimeout time.Duration
+    clock Clock
+    ctx context.Context     // cancelled by Kill
+    cancel context.CancelFunc
+    wg sync.WaitGroup       // the goroutines of the peer
+    conns map[net.Conn]bool
+    connlock sync.Mutex
     peers []string
     me int // index into peers[]
 
+    // Membership changes, see config.go
+    configs []Config
+    window int
+    known int   // every instance <= known is known
+    configlock sync.Mutex
+
     total int
     min []int
+    forgot int  // every instance <= forgot is forgotten
+    compacted int   // forgot when the log was last compacted
+    policy int
+    snapseq int // the sequence of the latest snapshot
     minlock sync.Mutex
     max int
     maxlock sync.Mutex
     alloc *paxosutility.PaxosAllocator
     result *paxosutility.PaxosResult
+    wal *paxosutility.PaxosLog
+
+    // Multi-Paxos, see leader.go
+    leaderMode bool
+    ballot paxosutility.Ballot  // promised to a leader for every instance
+    ballotlock sync.RWMutex
+    leading bool
+    leadBallot paxosutility.Ballot
+    leadValues map[int]interface{}
+    leadSeen paxosutility.Ballot    // the highest ballot seen in rejections
+    leaderlock sync.Mutex
+
+    // Subscribers wait on learnCond for new decisions and snapshots
+    learnlock sync.Mutex
+    learnCond *sync.Cond
+    snapshot paxosutility.Snapshot
+    sending map[int]bool    // peers a snapshot is being sent to
 }
 
 //--------------------------------------------------//
 
 // Maintain min and free memory
 
+// Forgetting policies
+const (
+    ForgetAll = iota    // forget what every peer is done with
+    ForgetMajority      // forget what a majority is done with, and a snapshot covers
+)
+
 func __min(arr []int) int {
     result := arr[0]
     for i := 1; i < len(arr); i++ {
@@ -45,17 +92,80 @@ func __min(arr []int) int {
     return result
 }
 
+// With ForgetMajority, a dead peer does not stop the others from forgetting.
+// It gets the latest snapshot when it comes back.
+// The application must call Snapshot() before Done() for anything to be
+// forgotten.
+func (px *Paxos) SetForgetPolicy(policy int) {
+    px.minlock.Lock()
+    defer px.minlock.Unlock()
+
+    px.policy = policy
+    px.forget()
+}
+
+// The bound allowed by the policy, with minlock held
+// Only the Done of the current members counts
+func (px *Paxos) bound() int {
+    done := []int{px.min[px.me]}
+    for _, i := range px.current() {
+        if i != px.me {
+            done = append(done, px.min[i])
+        }
+    }
+    if px.policy == ForgetAll {
+        return __min(done)
+    }
+
+    sort.Sort(sort.Reverse(sort.IntSlice(done)))
+    result := done[len(done) / 2]
+    if px.min[px.me] < result {
+        result = px.min[px.me]
+    }
+    if px.snapseq < result {
+        result = px.snapseq
+    }
+    return result
+}
+
+// Forget what the policy allows, with minlock held
+func (px *Paxos) forget() {
+    bound := px.bound()
+    if bound <= px.forgot {
+        return
+    }
+    px.forgot = bound
+    px.persist(paxosutility.LogRecord{Type: paxosutility.RecordForget, Seq: bound}, false)
+    px.alloc.Done(bound)
+    px.result.Done(bound)
+    px.forgetLeadValues(bound)
+
+    // The records of the forgotten instances are dropped from the log
+    if px.wal != nil && bound - px.compacted >= compactInterval && !px.isdead() {
+        px.compacted = bound
+        px.spawn(px.compactLog)
+    }
+}
+
 func (px *Paxos) refreshMin(seq int, index int) {
     px.minlock.Lock()
     defer px.minlock.Unlock()
 
+    if seq < px.forgot && index != px.me {
+        // The peer lost the instances forgotten here
+        px.spawn(func() { px.sendSnapshot(index) })
+    }
+    for len(px.min) <= index {
+        px.min = append(px.min, -1)
+    }
     if seq <= px.min[index] {
         return
     }
+    if index == px.me {
+        px.persist(paxosutility.LogRecord{Type: paxosutility.RecordDone, Seq: seq}, false)
+    }
     px.min[index] = seq
-    newbound := __min(px.min)
-    px.alloc.Done(newbound)
-    px.result.Done(newbound)
+    px.forget()
 }
 
 func (px *Paxos) getMin(index int) int {
@@ -69,7 +179,7 @@ func (px *Paxos) Min() int {
     px.minlock.Lock()
     defer px.minlock.Unlock()
 
-    return __min(px.min) + 1
+    return px.forgot + 1
 }
 
 func (px *Paxos) Done(seq int) {
@@ -98,39 +208,326 @@ func (px *Paxos) Max() int {
 
 //--------------------------------------------------//
 
-// Syscall and constructor
+// Write-ahead log
+
+// The log is compacted every time this many more instances are forgotten
+const compactInterval = 100
 
-func call(srv string, name string, args interface{}, reply interface{}) bool {
-    c, err := rpc.Dial("tcp", srv)
+// Append rec to the log if the peer is durable
+// Returns false if the record may not be on disk
+func (px *Paxos) persist(rec paxosutility.LogRecord, sync bool) bool {
+    if px.wal == nil {
+        return true
+    }
+    err := px.wal.Append(rec, sync)
     if err != nil {
-        err1 := err.(*net.OpError)
-        if err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
-            fmt.Printf("paxos Dial() failed: %v\n", err1)
+        if !px.isdead() {
+            fmt.Printf("Paxos(%v) log: %v\n", px.me, err)
         }
         return false
     }
-    defer c.Close()
+    return true
+}
 
-    err = c.Call(name, args, reply)
-    if err == nil {
-        return true
+// Record the decided value of instance seq
+func (px *Paxos) learn(seq int, v interface{}) {
+    if exist, _ := px.result.Read(seq); exist {
+        return
+    }
+    px.persist(paxosutility.LogRecord{Type: paxosutility.RecordDecided, Seq: seq, Va: v}, false)
+    px.learnConfig(seq, v)
+    px.result.Write(seq, v)
+
+    // Wake up the subscribers
+    px.learnlock.Lock()
+    px.learnCond.Broadcast()
+    px.learnlock.Unlock()
+}
+
+// Restore the state before restart, then compact the log
+func (px *Paxos) replay(records []paxosutility.LogRecord) {
+    done := -1
+    bound := -1
+    for _, rec := range records {
+        if rec.Type == paxosutility.RecordAcceptor {
+            data := px.alloc.Create(rec.Seq)
+            data.Np.Store(rec.Np)
+            data.Na.Store(rec.Na)
+            if rec.Va != nil {
+                data.Va.Store(rec.Va)
+            }
+            px.refreshMax(rec.Seq)
+        } else if rec.Type == paxosutility.RecordDecided {
+            px.result.Write(rec.Seq, rec.Va)
+            px.refreshMax(rec.Seq)
+        } else if rec.Type == paxosutility.RecordDone && rec.Seq > done {
+            done = rec.Seq
+        } else if rec.Type == paxosutility.RecordForget && rec.Seq > bound {
+            bound = rec.Seq
+        } else if rec.Type == paxosutility.RecordBallot && px.ballot.Less(rec.Np) {
+            px.ballot = rec.Np
+        } else if rec.Type == paxosutility.RecordConfig {
+            peers, _ := rec.Va.([]string)
+            px.addConfig(Config{rec.Seq, peers}, false)
+        }
+    }
+
+    // The others report their Done() again
+    px.forgot = bound
+    px.min[px.me] = bound
+    if done > bound {
+        px.min[px.me] = done
+    }
+    px.alloc.Done(bound)
+    px.result.Done(bound)
+
+    px.compacted = bound
+    if err := px.wal.Rewrite(px.compactRecords()); err != nil {
+        log.Fatal("paxos log error: ", err)
     }
+}
 
-    //fmt.Println(err)
-    return false
+// Rewrite the log without the forgotten instances
+func (px *Paxos) compactLog() {
+    if err := px.wal.Compact(px.compactRecords); err != nil && !px.isdead() {
+        fmt.Printf("Paxos(%v) log: %v\n", px.me, err)
+    }
 }
 
+// The records of the state of the peer, without the forgotten instances
+func (px *Paxos) compactRecords() []paxosutility.LogRecord {
+    px.minlock.Lock()
+    bound := px.forgot
+    done := px.min[px.me]
+    px.minlock.Unlock()
+    px.ballotlock.RLock()
+    ballot := px.ballot
+    px.ballotlock.RUnlock()
+
+    compact := []paxosutility.LogRecord{
+        {Type: paxosutility.RecordForget, Seq: bound},
+        {Type: paxosutility.RecordDone, Seq: done},
+        {Type: paxosutility.RecordBallot, Np: ballot},
+    }
+    for _, config := range px.Configs()[1:] {
+        compact = append(compact, paxosutility.LogRecord{Type: paxosutility.RecordConfig, Seq: config.Start, Va: config.Peers})
+    }
+    px.result.Range(func(seq int, v interface{}) {
+        compact = append(compact, paxosutility.LogRecord{Type: paxosutility.RecordDecided, Seq: seq, Va: v})
+    })
+    px.alloc.Range(func(seq int, data *paxosutility.PaxosData) {
+        if exist, _ := px.result.Read(seq); !exist {
+            np, _ := data.Np.Load().(paxosutility.Ballot)
+            na, _ := data.Na.Load().(paxosutility.Ballot)
+            compact = append(compact, paxosutility.LogRecord{Type: paxosutility.RecordAcceptor, Seq: seq, Np: np, Na: na, Va: data.Va.Load()})
+        }
+    })
+    return compact
+}
+
+//--------------------------------------------------//
+
+// Syscall and constructor
+
+// An RPC fails if the peer does not answer in time
+const rpcTimeout = 1 * time.Second
+
+func (px *Paxos) SetRPCTimeout(d time.Duration) {
+    px.rpcTimeout = d
+}
+
+// Send an RPC to peer i
+// Returns false once ctx is done or the RPC times out
+func (px *Paxos) call(ctx context.Context, i int, name string, args interface{}, reply interface{}) bool {
+    ctx, cancel := context.WithTimeout(ctx, px.rpcTimeout)
+    defer cancel()
+
+    ok := px.transport.Call(ctx, px.address(i), name, args, reply)
+    if ok {
+        atomic.AddInt64(&px.rpcCount, 1)
+    }
+    return ok
+}
+
+// Serve RPCs on conn until it is closed or the peer is killed
+func (px *Paxos) serve(rpcs *rpc.Server, conn net.Conn) {
+    defer px.wg.Done()
+
+    px.connlock.Lock()
+    if px.isdead() {
+        px.connlock.Unlock()
+        conn.Close()
+        return
+    }
+    px.conns[conn] = true
+    px.connlock.Unlock()
+
+    rpcs.ServeCodec(newServerCodec(px, conn))
+
+    px.connlock.Lock()
+    delete(px.conns, conn)
+    px.connlock.Unlock()
+}
+
+// The gob codec of net/rpc, which makes every RPC to an unreliable peer
+// fail on its own, as a connection is kept open across RPCs
+// A lost request or reply closes the connection, so that the caller fails
+// at once instead of waiting for its timeout.
+type serverCodec struct {
+    px *Paxos
+    conn net.Conn
+    dec *gob.Decoder
+    enc *gob.Encoder
+    buf *bufio.Writer
+    lost map[uint64]bool    // the requests whose reply is discarded
+    lock sync.Mutex
+}
+
+func newServerCodec(px *Paxos, conn net.Conn) *serverCodec {
+    buf := bufio.NewWriter(conn)
+    return &serverCodec{px, conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf, make(map[uint64]bool), sync.Mutex{}}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+    if err := c.dec.Decode(r); err != nil {
+        return err
+    }
+    if c.px.isunreliable() && (rand.Int63() % 1000) < 100 {
+        // discard the request.
+        c.conn.Close()
+        return errors.New("request discarded")
+    } else if c.px.isunreliable() && (rand.Int63() % 1000) < 200 {
+        // process the request but force discard of reply.
+        c.lock.Lock()
+        c.lost[r.Seq] = true
+        c.lock.Unlock()
+    }
+    return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+    return c.dec.Decode(body)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+    c.lock.Lock()
+    lost := c.lost[r.Seq]
+    delete(c.lost, r.Seq)
+    c.lock.Unlock()
+    if lost {
+        c.conn.Close()
+        return errors.New("reply discarded")
+    }
+
+    if err := c.enc.Encode(r); err != nil {
+        return err
+    }
+    if err := c.enc.Encode(body); err != nil {
+        return err
+    }
+    return c.buf.Flush()
+}
+
+func (c *serverCodec) Close() error {
+    return c.conn.Close()
+}
+
+func (px *Paxos) isdead() bool {
+    return atomic.LoadInt32(&px.dead) != 0
+}
+
+// An unreliable peer loses some of the RPCs it serves
+func (px *Paxos) SetUnreliable(on bool) {
+    if on {
+        atomic.StoreInt32(&px.unreliable, 1)
+    } else {
+        atomic.StoreInt32(&px.unreliable, 0)
+    }
+}
+
+func (px *Paxos) isunreliable() bool {
+    return atomic.LoadInt32(&px.unreliable) != 0
+}
+
+// Run f in a goroutine that Kill() waits for
+func (px *Paxos) spawn(f func()) {
+    px.wg.Add(1)
+    px.clock.Go(func() {
+        defer px.wg.Done()
+        f()
+    })
+}
+
+// Sleep for d, or until the peer is killed
+func (px *Paxos) sleep(d time.Duration) {
+    if _, ok := px.clock.(realClock); !ok {
+        px.clock.Sleep(d)
+        return
+    }
+    select {
+    case <-time.After(d):
+    case <-px.ctx.Done():
+    }
+}
+
+// Stop the peer, and return once every goroutine of it has exited
+// In a simulation the goroutines only exit as the Sim runs, so Kill()
+// does not wait for them.
 func (px *Paxos) Kill() {
-    px.dead = true
+    atomic.StoreInt32(&px.dead, 1)
+    px.cancel()
     if px.l != nil {
         px.l.Close()
     }
+    px.connlock.Lock()
+    for conn, _ := range px.conns {
+        conn.Close()
+    }
+    px.connlock.Unlock()
+    px.transport.Close()
+    px.learnlock.Lock()
+    px.learnCond.Broadcast()
+    px.learnlock.Unlock()
+
+    if _, ok := px.clock.(realClock); ok {
+        px.wg.Wait()
+    }
+    if px.wal != nil {
+        px.wal.Close()
+    }
 }
 
 func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+    return MakeWithTransport(peers, me, rpcs, "", NewTCPTransport())
+}
+
+// Same as Make, but the peer keeps its acceptor state and decisions in a
+// write-ahead log under dir, and replays the log when it is restarted.
+// An empty dir means the peer keeps everything in memory only.
+func MakeWithDir(peers []string, me int, rpcs *rpc.Server, dir string) *Paxos {
+    return MakeWithTransport(peers, me, rpcs, dir, NewTCPTransport())
+}
+
+// Same as MakeWithDir, but the peer talks to the others through transport
+func MakeWithTransport(peers []string, me int, rpcs *rpc.Server, dir string, transport Transport) *Paxos {
+    return MakeReconfigurable(peers, peers, 0, me, rpcs, dir, transport)
+}
+
+// Same as MakeWithTransport, but the group allows membership changes with
+// a window of instances, see config.go.
+// first is the configuration of instance 0, which all peers must agree on.
+// A peer that joins a running group passes the configuration the group was
+// started with, even though it is not in it.
+func MakeReconfigurable(peers []string, first []string, window int, me int, rpcs *rpc.Server, dir string, transport Transport) *Paxos {
     px := &Paxos{}
-    px.peers = peers
+    px.peers = append([]string{}, peers...)
     px.me = me
+    px.configs = []Config{{0, first}}
+    px.window = window
+    px.known = -1
+    px.transport = transport
+    px.clock = realClock{}
+    px.conns = make(map[net.Conn]bool)
 
     // Your initialization code here.
     px.total = len(peers)
@@ -138,11 +535,39 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
     for i := 0; i < px.total; i++ {
         px.min[i] = -1
     }
+    px.forgot = -1
+    px.compacted = -1
+    px.policy = ForgetAll
+    px.snapseq = -1
     px.minlock = sync.Mutex{}
     px.max = -1
     px.maxlock = sync.Mutex{}
     px.alloc = paxosutility.NewPaxosAllocator()
     px.result = paxosutility.NewPaxosResult()
+    px.ballot = paxosutility.Ballot{}
+    px.leadBallot = paxosutility.Ballot{}
+    px.leadSeen = paxosutility.Ballot{}
+    px.leadValues = make(map[int]interface{})
+    px.rpcTimeout = rpcTimeout
+    px.ctx, px.cancel = context.WithCancel(context.Background())
+    px.learnCond = sync.NewCond(&px.learnlock)
+    px.snapshot = paxosutility.Snapshot{Seq: -1}
+    px.sending = make(map[int]bool)
+
+    if dir != "" {
+        wal, records, err := paxosutility.OpenPaxosLog(dir)
+        if err != nil {
+            log.Fatal("paxos log error: ", err)
+        }
+        px.wal = wal
+        px.snapshot, err = wal.ReadSnapshot()
+        if err != nil {
+            log.Fatal("paxos snapshot error: ", err)
+        }
+        px.refreshMax(px.snapshot.Seq)
+        px.snapseq = px.snapshot.Seq
+        px.replay(records)
+    }
 
     if rpcs != nil {
         // caller will create socket &c
@@ -153,7 +578,7 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
         // prepare to receive connections from clients.
         // change "unix" to "tcp" to use over a network.
         // os.Remove(peers[me]) // only needed for "unix"
-        l, e := net.Listen("tcp", peers[me]);
+        l, e := px.transport.Listen(peers[me]);
         if e != nil {
             log.Fatal("listen error: ", e);
         }
@@ -163,31 +588,19 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
         // or do anything to subvert it.
 
         // create a thread to accept RPC connections
+        px.wg.Add(1)
         go func() {
-            for px.dead == false {
+            defer px.wg.Done()
+            for !px.isdead() {
                 conn, err := px.l.Accept()
-                if err == nil && px.dead == false {
-                    if px.unreliable && (rand.Int63() % 1000) < 100 {
-                        // discard the request.
-                        conn.Close()
-                    } else if px.unreliable && (rand.Int63() % 1000) < 200 {
-                        // process the request but force discard of reply.
-                        c1 := conn.(*net.UnixConn)
-                        f, _ := c1.File()
-                        err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-                        if err != nil {
-                            fmt.Printf("shutdown: %v\n", err)
-                        }
-                        px.rpcCount++
-                        go rpcs.ServeConn(conn)
-                    } else {
-                        px.rpcCount++
-                        go rpcs.ServeConn(conn)
-                    }
+                if err == nil && !px.isdead() {
+                    // An unreliable peer loses RPCs in serve
+                    px.wg.Add(1)
+                    go px.serve(rpcs, conn)
                 } else if err == nil {
                     conn.Close()
                 }
-                if err != nil && px.dead == false {
+                if err != nil && !px.isdead() {
                     fmt.Printf("Paxos(%v) accept: %v\n", me, err.Error())
                 }
             }
@@ -203,7 +616,7 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
 
 type PrepareArgs struct {
     Seq int
-    N int
+    N paxosutility.Ballot
     Doneseq int
     Index int
 }
@@ -212,13 +625,15 @@ type PrepareReplys struct {
     Doneseq int
     Decided bool
     Decidedval interface{}
+    Forgotten bool
     Ok bool
-    Na int
+    Np paxosutility.Ballot  // the highest ballot promised, when not ok
+    Na paxosutility.Ballot
     Va interface{}
 }
 
 func (px *Paxos) HandlePrepare(args PrepareArgs, replys *PrepareReplys) error {
-    if px.dead {
+    if px.isdead() {
         return nil
     }
 
@@ -234,17 +649,33 @@ func (px *Paxos) HandlePrepare(args PrepareArgs, replys *PrepareReplys) error {
     }
     replys.Decided = false
 
+    // A leader's promise covers every instance, so it must not change
+    // while this instance is being promised
+    px.ballotlock.RLock()
+    defer px.ballotlock.RUnlock()
+
+    // Never accept anything in an instance that may be decided and forgotten
     data := px.alloc.Create(args.Seq)
+    if data == nil {
+        replys.Forgotten = true
+        return nil
+    }
     data.Lock.Lock()
     defer data.Lock.Unlock()
 
-    if Np, _ := data.Np.Load().(int); args.N > Np {
+    if Np, _ := data.Np.Load().(paxosutility.Ballot); Np.Less(args.N) && px.ballot.Less(args.N) {
         data.Np.Store(args.N)
-        replys.Ok = true
-        replys.Na, _ = data.Na.Load().(int)
+        replys.Na, _ = data.Na.Load().(paxosutility.Ballot)
         replys.Va = data.Va.Load()
+        // The promise must be on disk before it is sent
+        rec := paxosutility.LogRecord{Type: paxosutility.RecordAcceptor, Seq: args.Seq, Np: args.N, Na: replys.Na, Va: replys.Va}
+        replys.Ok = px.persist(rec, true)
     } else {
         replys.Ok = false
+        replys.Np = Np
+        if Np.Less(px.ballot) {
+            replys.Np = px.ballot
+        }
     }
     return nil
 }
@@ -253,7 +684,7 @@ func (px *Paxos) HandlePrepare(args PrepareArgs, replys *PrepareReplys) error {
 
 type AcceptArgs struct {
     Seq int
-    N int
+    N paxosutility.Ballot
     V interface{}
     Doneseq int
     Index int
@@ -263,11 +694,13 @@ type AcceptReplys struct {
     Doneseq int
     Decided bool
     Decidedval interface{}
+    Forgotten bool
     Ok bool
+    Np paxosutility.Ballot  // the highest ballot promised, when not ok
 }
 
 func (px *Paxos) HandleAccept(args AcceptArgs, replys *AcceptReplys) error {
-    if px.dead {
+    if px.isdead() {
         return nil
     }
 
@@ -283,17 +716,31 @@ func (px *Paxos) HandleAccept(args AcceptArgs, replys *AcceptReplys) error {
     }
     replys.Decided = false
 
+    px.ballotlock.RLock()
+    defer px.ballotlock.RUnlock()
+
+    // Never accept anything in an instance that may be decided and forgotten
     data := px.alloc.Create(args.Seq)
+    if data == nil {
+        replys.Forgotten = true
+        return nil
+    }
     data.Lock.Lock()
     defer data.Lock.Unlock()
 
-    if Np, _ := data.Np.Load().(int); args.N >= Np {
+    if Np, _ := data.Np.Load().(paxosutility.Ballot); !args.N.Less(Np) && !args.N.Less(px.ballot) {
         data.Np.Store(args.N)
         data.Na.Store(args.N)
         data.Va.Store(args.V)
-        replys.Ok = true
+        // The accepted value must be on disk before it is acknowledged
+        rec := paxosutility.LogRecord{Type: paxosutility.RecordAcceptor, Seq: args.Seq, Np: args.N, Na: args.N, Va: args.V}
+        replys.Ok = px.persist(rec, true)
     } else {
         replys.Ok = false
+        replys.Np = Np
+        if Np.Less(px.ballot) {
+            replys.Np = px.ballot
+        }
     }
     return nil
 }
@@ -312,7 +759,7 @@ type DecideReplys struct {
 }
 
 func (px *Paxos) HandleDecide(args DecideArgs, replys *DecideReplys) error {
-    if px.dead {
+    if px.isdead() {
         return nil
     }
 
@@ -321,166 +768,232 @@ func (px *Paxos) HandleDecide(args DecideArgs, replys *DecideReplys) error {
 
     replys.Doneseq = px.getMin(px.me)
 
-    px.result.Write(args.Seq, args.V)
+    px.learn(args.Seq, args.V)
     return nil
 }
 
 //--------------------------------------------------//
 
-func (px *Paxos) propose(seq int, v interface{}) {
-    // Refresh the max
-    px.refreshMax(seq)
-
-    // Allocate memory for proposer instance
-    data := px.alloc.Create(seq)
-
-    for ; !px.dead; time.Sleep(500 * time.Millisecond) {
-        // If the instance is already abandoned, then break
-        if seq < px.Min() {
-            return
-        }
-
-        // If the instance already decides, then break
-        if exist, _ := px.result.Read(seq); exist {
-            break
-        }
-
-        // Find a large enough n to be a new proposal round
-        // n = me (mod total)
-        n, _ := data.Np.Load().(int)
-        {
-            tmp := (n / px.total) * px.total + px.me
-            for tmp <= n {
-                tmp += px.total
-            }
-            n = tmp
-        }
-
-        // Send prepare(n) to all servers including itself
-        success := 0
-        na := -1
-        va := v
-        for i := 0; i < px.total; i++ {
-            args := PrepareArgs{seq, n, px.getMin(px.me), px.me}
+// Send prepare(n) to all servers including itself at the same time
+// Returns whether a majority promised, the value to propose, and the
+// highest ballot promised by the peers that refused
+func (px *Paxos) sendPrepare(ctx context.Context, seq int, n paxosutility.Ballot, v interface{}) (bool, interface{}, paxosutility.Ballot) {
+    args := PrepareArgs{seq, n, px.getMin(px.me), px.me}
+    members := px.members(seq)
+    total := len(members)
+    mb := px.clock.Mailbox(total)
+    for _, i := range members {
+        i := i
+        px.spawn(func() {
             replys := &PrepareReplys{}
-            if px.dead {
-                return
-            }
             if i != px.me {
-                ok := call(px.peers[i], "Paxos.HandlePrepare", args, replys)
-                if !ok {
-                    // fmt.Println("Paxos", seq, "Peer", px.me, "Round", n, "prepare_ack from", i, "failed")
-                    continue
+                if !px.call(ctx, i, "Paxos.HandlePrepare", args, replys) {
+                    mb.Put(nil)
+                    return
                 }
-                // fmt.Println("Paxos", seq, "Peer", px.me, "Round", n, "prepare_ack from", i, replys.Ok)
             } else {
                 px.HandlePrepare(args, replys)
-                // fmt.Println("Paxos", seq, "Peer", px.me, "Round", n, "prepare_ack from", i, replys.Ok)
             }
-
-            // Update the Done seq
+            // Update the Done seq, even if the round is already over
             px.refreshMin(replys.Doneseq, i)
-            if seq < px.Min() {
-                return
-            }
-
-            // If the instance seq is already decided, then just learns it and returns
-            if replys.Decided {
-                px.result.Write(seq, replys.Decidedval)
-                go px.broadcast(seq, replys.Decidedval)
-                return
-            }
+            mb.Put(replys)
+        })
+    }
 
-            if replys.Ok {
-                success++
-                if replys.Na > na {
-                    na = replys.Na
-                    va = replys.Va
-                }
-            }
+    // Wait until the majority is reached or becomes impossible
+    success := 0
+    failure := 0
+    na := paxosutility.Ballot{}
+    va := v
+    np := paxosutility.Ballot{}
+    for success + success <= total && failure + failure < total {
+        replys, _ := mb.Get().(*PrepareReplys)
+        if px.isdead() || px.forgotten(seq) {
+            return false, nil, np
         }
 
-        // fmt.Println("Paxos", seq, "Peer", px.me, "Round", n, "prepare success number", success)
-        // If not prepare_ok from majority, then restart
-        if success + success <= px.total {
-            continue
+        // If the instance seq is already decided, then just learns it and returns
+        if replys != nil && replys.Decided {
+            px.decide(seq, replys.Decidedval)
+            return false, nil, np
         }
 
-        // Send accept(n, va) to all servers including itself
-        success = 0
-        for i := 0; i < px.total; i++ {
-            if px.dead {
-                return
+        if replys != nil && replys.Ok {
+            success++
+            if na.Less(replys.Na) {
+                na = replys.Na
+                va = replys.Va
+            }
+        } else {
+            failure++
+            if replys != nil && np.Less(replys.Np) {
+                np = replys.Np
             }
+        }
+    }
 
-            args := AcceptArgs{seq, n, va, px.getMin(px.me), px.me}
-            replys := &AcceptReplys{}
+    // fmt.Println("Paxos", seq, "Peer", px.me, "Round", n, "prepare success number", success)
+    return success + success > total, va, np
+}
 
+// Send accept(n, va) to all servers including itself at the same time
+// Returns whether a majority accepted, and the highest round promised by
+// the peers that refused
+func (px *Paxos) sendAccept(ctx context.Context, seq int, n paxosutility.Ballot, va interface{}) (bool, paxosutility.Ballot) {
+    args := AcceptArgs{seq, n, va, px.getMin(px.me), px.me}
+    members := px.members(seq)
+    total := len(members)
+    mb := px.clock.Mailbox(total)
+    for _, i := range members {
+        i := i
+        px.spawn(func() {
+            replys := &AcceptReplys{}
             if i != px.me {
-                ok := call(px.peers[i], "Paxos.HandleAccept", args, replys)
-                if !ok {
-                    // fmt.Println("Paxos", seq, "Peer", px.me, "Round", n, "accept_ack from", i, "failed")
-                    continue
+                if !px.call(ctx, i, "Paxos.HandleAccept", args, replys) {
+                    mb.Put(nil)
+                    return
                 }
-                // fmt.Println("Paxos", seq, "Peer", px.me, "Round", n, "accept_ack from", i, replys.Ok)
             } else {
                 px.HandleAccept(args, replys)
-                // fmt.Println("Paxos", seq, "Peer", px.me, "Round", n, "accept_ack from", i, replys.Ok)
             }
-
-            // Update the Done seq
+            // Update the Done seq, even if the round is already over
             px.refreshMin(replys.Doneseq, i)
+            mb.Put(replys)
+        })
+    }
 
-            // If the instance seq is already decided, then just learns it and returns
-            if replys.Decided {
-                px.result.Write(seq, replys.Decidedval)
-                go px.broadcast(seq, replys.Decidedval)
-                return
-            }
+    // Wait until the majority is reached or becomes impossible
+    success := 0
+    failure := 0
+    np := paxosutility.Ballot{}
+    for success + success <= total && failure + failure < total {
+        replys, _ := mb.Get().(*AcceptReplys)
+        if px.isdead() {
+            return false, np
+        }
+
+        // If the instance seq is already decided, then just learns it and returns
+        if replys != nil && replys.Decided {
+            px.decide(seq, replys.Decidedval)
+            return false, np
+        }
 
-            if replys.Ok {
-                success++
+        if replys != nil && replys.Ok {
+            success++
+        } else {
+            failure++
+            if replys != nil && np.Less(replys.Np) {
+                np = replys.Np
             }
         }
+    }
 
-        // After update several doneseq, check whether current seq is done or not
-        if seq < px.Min() {
+    // After update several doneseq, check whether current seq is done or not
+    if px.forgotten(seq) {
+        return false, np
+    }
+
+    // fmt.Println("Paxos", seq, "Peer", px.me, "Round", n, "accept success number", success)
+    return success + success > total, np
+}
+
+// Decide va, and send decided(va) to all servers exclude itself
+func (px *Paxos) decide(seq int, va interface{}) {
+    px.learn(seq, va)
+    px.spawn(func() { px.broadcast(px.ctx, seq, va) })
+}
+
+// Propose v in instance seq until it is decided or ctx is done
+func (px *Paxos) propose(ctx context.Context, seq int, v interface{}) {
+    // Refresh the max
+    px.refreshMax(seq)
+
+    if px.leaderMode {
+        px.proposeLeader(ctx, seq, v)
+        return
+    }
+
+    // Allocate memory for proposer instance
+    data := px.alloc.Create(seq)
+    if data == nil {
+        return
+    }
+
+    // Learn the configuration of seq first
+    if px.window > 0 && !px.waitConfig(seq) {
+        return
+    }
+
+    b := px.newBackoff(seq)
+    hint := paxosutility.Ballot{}   // the highest ballot the other peers refused with
+    for ctx.Err() == nil {
+        // If the instance is already abandoned, then break
+        if px.forgotten(seq) {
             return
         }
 
-        // fmt.Println("Paxos", seq, "Peer", px.me, "Round", n, "accept success number", success)
-        // If not prepare_ok from majority, then restart
-        if success + success <= px.total {
-            continue
+        // If the instance already decides, then break
+        if exist, _ := px.result.Read(seq); exist {
+            break
         }
 
-        // Decide va
-        px.result.Write(seq, va)
-
-        // Send decided(va) to all servers exclude itself
-        go px.broadcast(seq, va)
+        // Find a ballot of this peer past the ballots promised here and by
+        // the peers that refused
+        np, _ := data.Np.Load().(paxosutility.Ballot)
+        if np.Less(hint) {
+            np = hint
+        }
+        n := np.Next(px.me)
+
+        // If not prepare_ok and accept_ok from majority, then back off and restart
+        ok, va, refused := px.sendPrepare(ctx, seq, n, v)
+        if ok {
+            if ok, refused = px.sendAccept(ctx, seq, n, va); ok {
+                px.decide(seq, va)
+                continue
+            }
+        }
+        if hint.Less(refused) {
+            hint = refused
+        }
+        np, _ = data.Np.Load().(paxosutility.Ballot)
+        if np.Less(hint) {
+            np = hint
+        }
+        b.sleep(n, np)
     }
 }
 
 //--------------------------------------------------//
 
-func (px *Paxos) broadcast(seq int, v interface{}) {
+func (px *Paxos) broadcast(ctx context.Context, seq int, v interface{}) {
+    // The new members learn their configuration too
+    targets := make([]bool, maxPeers)
+    for _, i := range px.members(seq) {
+        targets[i] = true
+    }
+    if r, ok := v.(Reconfig); ok && px.window > 0 {
+        for _, i := range slots(r.Peers) {
+            targets[i] = true
+        }
+    }
+
     l := list.New()
-    for i := 0; i < px.total; i++ {
-        if i != px.me {
+    for i := 0; i < len(targets); i++ {
+        if targets[i] && i != px.me {
             l.PushBack(i)
         }
     }
 
     for seq >= px.Min() && l.Len() > 0 {
         for e := l.Front(); e != nil; {
-            if px.dead {
+            if ctx.Err() != nil {
                 return
             }
             i, _ := e.Value.(int)
             args := DecideArgs{seq, v, px.getMin(px.me), px.me}
             replys := &DecideReplys{}
-            ok := call(px.peers[i], "Paxos.HandleDecide", args, replys)
+            ok := px.call(ctx, i, "Paxos.HandleDecide", args, replys)
             if !ok {
                 e = e.Next()
             } else {
@@ -496,15 +1009,231 @@ func (px *Paxos) broadcast(seq int, v interface{}) {
 //--------------------------------------------------//
 
 func (px *Paxos) Start(seq int, v interface{}) {
-    if px.dead {
+    if px.isdead() {
+        return
+    }
+    px.spawn(func() { px.propose(px.ctx, seq, v) })
+}
+
+// Same as Start, but the proposer gives up once ctx is done
+func (px *Paxos) StartContext(ctx context.Context, seq int, v interface{}) {
+    if px.isdead() {
+        return
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    stop := context.AfterFunc(px.ctx, cancel)
+    px.spawn(func() {
+        defer cancel()
+        defer stop()
+        px.propose(ctx, seq, v)
+    })
+}
+
+// The fate of an instance, as known to this peer
+type Fate int
+
+const (
+    Decided Fate = iota + 1
+    Pending     // not decided yet, or the peer is dead
+    Forgotten   // freed after Done(), or only covered by a snapshot
+)
+
+func (f Fate) String() string {
+    switch f {
+    case Decided:
+        return "Decided"
+    case Pending:
+        return "Pending"
+    case Forgotten:
+        return "Forgotten"
+    }
+    return "Fate(" + strconv.Itoa(int(f)) + ")"
+}
+
+// The fate of instance seq, and its value if decided
+// A Forgotten instance must be recovered from the latest snapshot.
+func (px *Paxos) Status(seq int) (Fate, interface{}) {
+    if px.isdead() {
+        return Pending, nil
+    }
+    if seq < px.Min() {
+        return Forgotten, nil
+    }
+    if exist, v := px.result.Read(seq); exist {
+        return Decided, v
+    }
+    if px.forgotten(seq) {
+        return Forgotten, nil
+    }
+    return Pending, nil
+}
+
+//--------------------------------------------------//
+
+// Notification of decisions
+
+type Decision struct {
+    Seq int
+    Value interface{}
+    Snapshot bool   // Value is the []byte snapshot of every instance <= Seq
+}
+
+// Wait until instance seq is decided locally, or covered by a snapshot
+// Returns false if the peer is killed, or the instance is forgotten
+func (px *Paxos) waitDecided(seq int) (Decision, bool) {
+    px.learnlock.Lock()
+    defer px.learnlock.Unlock()
+
+    for !px.isdead() {
+        if exist, v := px.result.Read(seq); exist {
+            return Decision{seq, v, false}, true
+        }
+        if seq <= px.snapshot.Seq {
+            return Decision{px.snapshot.Seq, px.snapshot.Data, true}, true
+        }
+        if seq < px.Min() {
+            break
+        }
+        px.learnCond.Wait()
+    }
+    return Decision{}, false
+}
+
+// Deliver the decided instances from seq on, in order, as soon as each of
+// them is decided locally.
+// If the next instance is only covered by a snapshot, the snapshot is
+// delivered instead, and the instances after it follow.
+// The channel is closed when the peer is killed, or when the next instance
+// is forgotten before it could be delivered.
+func (px *Paxos) Subscribe(seq int) <-chan Decision {
+    ch := make(chan Decision)
+    px.wg.Add(1)
+    go func() {
+        defer px.wg.Done()
+        defer close(ch)
+        for {
+            d, ok := px.waitDecided(seq)
+            if !ok {
+                return
+            }
+            select {
+            case ch <- d:
+            case <-px.ctx.Done():
+                return
+            }
+            seq = d.Seq + 1
+        }
+    }()
+    return ch
+}
+
+//--------------------------------------------------//
+
+// Snapshots
+// The application hands its state to Snapshot(), and it is sent to the
+// peers that are behind the instances forgotten here.
+
+// Whether instance seq is forgotten, or covered by a snapshot
+func (px *Paxos) forgotten(seq int) bool {
+    if seq < px.Min() {
+        return true
+    }
+
+    px.learnlock.Lock()
+    defer px.learnlock.Unlock()
+
+    return seq <= px.snapshot.Seq
+}
+
+// Keep data as the state of the application after every instance <= seq
+// is applied. The caller should call Done(seq) after it.
+func (px *Paxos) Snapshot(seq int, data []byte) {
+    px.installSnapshot(paxosutility.Snapshot{Seq: seq, Data: data})
+}
+
+func (px *Paxos) installSnapshot(snap paxosutility.Snapshot) bool {
+    px.learnlock.Lock()
+    defer px.learnlock.Unlock()
+
+    if snap.Seq <= px.snapshot.Seq {
+        return false
+    }
+    if px.wal != nil {
+        if err := px.wal.WriteSnapshot(snap); err != nil {
+            if !px.isdead() {
+                fmt.Printf("Paxos(%v) snapshot: %v\n", px.me, err)
+            }
+            return false
+        }
+    }
+    px.snapshot = snap
+    px.learnCond.Broadcast()
+
+    px.minlock.Lock()
+    px.snapseq = snap.Seq
+    px.forget()
+    px.minlock.Unlock()
+    return true
+}
+
+// Send the latest snapshot to peer i
+func (px *Paxos) sendSnapshot(i int) {
+    px.learnlock.Lock()
+    snap := px.snapshot
+    if snap.Seq < 0 || px.sending[i] || px.isdead() {
+        px.learnlock.Unlock()
         return
     }
-    go px.propose(seq, v)
+    px.sending[i] = true
+    px.learnlock.Unlock()
+
+    args := InstallSnapshotArgs{snap.Seq, snap.Data, px.Configs(), px.getMin(px.me), px.me}
+    replys := &InstallSnapshotReplys{}
+    ok := px.call(px.ctx, i, "Paxos.HandleInstallSnapshot", args, replys)
+
+    // Do not flood a peer that cannot install it
+    px.sleep(100 * time.Millisecond)
+    px.learnlock.Lock()
+    delete(px.sending, i)
+    px.learnlock.Unlock()
+
+    if ok {
+        px.refreshMin(replys.Doneseq, i)
+    }
+}
+
+//--------------------------------------------------//
+
+// HandleInstallSnapshot RPC
+
+type InstallSnapshotArgs struct {
+    Seq int
+    Data []byte
+    Configs []Config    // the configurations decided in the instances covered
+    Doneseq int
+    Index int
 }
 
-func (px *Paxos) Status(seq int) (bool, interface{}) {
-    if px.dead {
-        return false, nil
+type InstallSnapshotReplys struct {
+    Doneseq int
+}
+
+func (px *Paxos) HandleInstallSnapshot(args InstallSnapshotArgs, replys *InstallSnapshotReplys) error {
+    if px.isdead() {
+        return nil
+    }
+
+    px.refreshMax(args.Seq)
+    px.refreshMin(args.Doneseq, args.Index)
+    for _, config := range args.Configs {
+        px.addConfig(config, true)
     }
-    return px.result.Read(seq)
+
+    // The snapshot replaces every instance it covers
+    if args.Seq > px.getMin(px.me) && px.installSnapshot(paxosutility.Snapshot{Seq: args.Seq, Data: args.Data}) {
+        px.refreshMin(args.Seq, px.me)
+    }
+
+    replys.Doneseq = px.getMin(px.me)
+    return nil
 }
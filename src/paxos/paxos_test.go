@@ -1,5 +1,7 @@
 package paxos
 
+import "paxos/paxosutility"
+
 import "testing"
 import "runtime"
 import "strconv"
@@ -7,6 +9,13 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "io/ioutil"
+import "path/filepath"
+import "net/rpc"
+import "net"
+import "sync/atomic"
+import "flag"
+import "context"
 
 func port(tag string, host int) string {
     s := "/var/tmp/824-"
@@ -19,13 +28,20 @@ func port(tag string, host int) string {
     return s
 }
 
+// every peer in the tests talks through this in-memory network
+var network = NewMemNetwork()
+
+func makePaxos(peers []string, me int) *Paxos {
+    return MakeWithTransport(peers, me, nil, "", network.Transport())
+}
+
 func ndecided(t *testing.T, pxa []*Paxos, seq int) int {
     count := 0
     var v interface{}
     for i := 0; i < len(pxa); i++ {
         if pxa[i] != nil {
-            decided, v1 := pxa[i].Status(seq)
-            if decided {
+            fate, v1 := pxa[i].Status(seq)
+            if fate == Decided {
                 if count > 0 && v != v1 {
                     t.Fatalf("decided values do not match; seq=%v i=%v v=%v v1=%v", seq, i, v, v1)
                 }
@@ -86,7 +102,7 @@ func testBasic(t *testing.T) {
         pxh[i] = port("basic", i)
     }
     for i := 0; i < npaxos; i++ {
-        pxa[i] = Make(pxh, i, nil)
+        pxa[i] = makePaxos(pxh, i)
     }
 
     fmt.Printf("Test: Single proposer ...\n")
@@ -146,7 +162,7 @@ func testDeaf(t *testing.T) {
         pxh[i] = port("deaf", i)
     }
     for i := 0; i < npaxos; i++ {
-        pxa[i] = Make(pxh, i, nil)
+        pxa[i] = makePaxos(pxh, i)
     }
 
     fmt.Printf("Test: Deaf proposer ...\n")
@@ -189,7 +205,7 @@ func testForget(t *testing.T) {
         pxh[i] = port("gc", i)
     }
     for i := 0; i < npaxos; i++ {
-        pxa[i] = Make(pxh, i, nil)
+        pxa[i] = makePaxos(pxh, i)
     }
 
     fmt.Printf("Test: Forgetting ...\n")
@@ -271,8 +287,8 @@ func testManyForget(t *testing.T) {
         pxh[i] = port("manygc", i)
     }
     for i := 0; i < npaxos; i++ {
-        pxa[i] = Make(pxh, i, nil)
-        pxa[i].unreliable = true
+        pxa[i] = makePaxos(pxh, i)
+        pxa[i].SetUnreliable(true)
     }
 
     fmt.Printf("Test: Lots of forgetting ...\n")
@@ -296,8 +312,8 @@ func testManyForget(t *testing.T) {
             seq := (rand.Int() % maxseq)
             i := (rand.Int() % npaxos)
             if seq >= pxa[i].Min() {
-                decided, _ := pxa[i].Status(seq)
-                if decided {
+                fate, _ := pxa[i].Status(seq)
+                if fate == Decided {
                     pxa[i].Done(seq)
                 }
             }
@@ -308,7 +324,7 @@ func testManyForget(t *testing.T) {
     time.Sleep(5 * time.Second)
     done = true
     for i := 0; i < npaxos; i++ {
-        pxa[i].unreliable = false
+        pxa[i].SetUnreliable(false)
     }
     time.Sleep(2 * time.Second)
 
@@ -340,7 +356,7 @@ func testForgetMem(t *testing.T) {
         pxh[i] = port("gcmem", i)
     }
     for i := 0; i < npaxos; i++ {
-        pxa[i] = Make(pxh, i, nil)
+        pxa[i] = makePaxos(pxh, i)
     }
 
     pxa[0].Start(0, "x")
@@ -404,7 +420,7 @@ func testRPCCount(t *testing.T) {
         pxh[i] = port("count", i)
     }
     for i := 0; i < npaxos; i++ {
-        pxa[i] = Make(pxh, i, nil)
+        pxa[i] = makePaxos(pxh, i)
     }
 
     ninst1 := 5
@@ -419,7 +435,7 @@ func testRPCCount(t *testing.T) {
 
     total1 := 0
     for j := 0; j < npaxos; j++ {
-        total1 += pxa[j].rpcCount
+        total1 += int(atomic.LoadInt64(&pxa[j].rpcCount))
     }
 
     // per agreement:
@@ -444,7 +460,7 @@ func testRPCCount(t *testing.T) {
 
     total2 := 0
     for j := 0; j < npaxos; j++ {
-        total2 += pxa[j].rpcCount
+        total2 += int(atomic.LoadInt64(&pxa[j].rpcCount))
     }
     total2 -= total1
 
@@ -477,7 +493,7 @@ func testMany(t *testing.T) {
         pxh[i] = port("many", i)
     }
     for i := 0; i < npaxos; i++ {
-        pxa[i] = Make(pxh, i, nil)
+        pxa[i] = makePaxos(pxh, i)
         pxa[i].Start(0, 0)
     }
 
@@ -527,20 +543,20 @@ func testOld(t *testing.T) {
         pxh[i] = port("old", i)
     }
 
-    pxa[1] = Make(pxh, 1, nil)
-    pxa[2] = Make(pxh, 2, nil)
-    pxa[3] = Make(pxh, 3, nil)
+    pxa[1] = makePaxos(pxh, 1)
+    pxa[2] = makePaxos(pxh, 2)
+    pxa[3] = makePaxos(pxh, 3)
     pxa[1].Start(1, 111)
 
     waitmajority(t, pxa, 1)
 
-    pxa[0] = Make(pxh, 0, nil)
+    pxa[0] = makePaxos(pxh, 0)
     pxa[0].Start(1, 222)
 
     waitn(t, pxa, 1, 4)
 
     if false {
-        pxa[4] = Make(pxh, 4, nil)
+        pxa[4] = makePaxos(pxh, 4)
         waitn(t, pxa, 1, npaxos)
     }
 
@@ -564,8 +580,8 @@ func testManyUnreliable(t *testing.T) {
         pxh[i] = port("manyun", i)
     }
     for i := 0; i < npaxos; i++ {
-        pxa[i] = Make(pxh, i, nil)
-        pxa[i].unreliable = true
+        pxa[i] = makePaxos(pxh, i)
+        pxa[i].SetUnreliable(true)
         pxa[i].Start(0, 0)
     }
 
@@ -611,8 +627,8 @@ func TestManyUnreliableNotConcurrent(t *testing.T) {
         pxh[i] = port("manyun", i)
     }
     for i := 0; i < npaxos; i++ {
-        pxa[i] = Make(pxh, i, nil)
-        pxa[i].unreliable = true
+        pxa[i] = makePaxos(pxh, i)
+        pxa[i].SetUnreliable(true)
     }
 
     for seq := 1; seq < 50; seq++ {
@@ -625,68 +641,41 @@ func TestManyUnreliableNotConcurrent(t *testing.T) {
     fmt.Printf("  ... Passed\n")
 }
 
-func pp(tag string, src int, dst int) string {
-    s := "/var/tmp/824-"
-    s += strconv.Itoa(os.Getuid()) + "/"
-    s += "px-" + tag + "-"
-    s += strconv.Itoa(os.Getpid()) + "-"
-    s += strconv.Itoa(src) + "-"
-    s += strconv.Itoa(dst)
-    return s
-}
+// the peers of the tests with partitions send through faults
+var faults = NewFaults()
 
-func cleanpp(tag string, n int) {
-    for i := 0; i < n; i++ {
-        for j := 0; j < n; j++ {
-            ij := pp(tag, i, j)
-            os.Remove(ij)
-        }
-    }
+func makeFaultyPaxos(peers []string, me int) *Paxos {
+    return MakeWithTransport(peers, me, nil, "", faults.Transport(peers[me], network.Transport()))
 }
 
 func part(t *testing.T, tag string, npaxos int, p1 []int, p2 []int, p3 []int) {
-    cleanpp(tag, npaxos)
-
     pa := [][]int{p1, p2, p3}
+    groups := make([][]string, len(pa))
     for pi := 0; pi < len(pa); pi++ {
         p := pa[pi]
         for i := 0; i < len(p); i++ {
-            for j := 0; j < len(p); j++ {
-                ij := pp(tag, p[i], p[j])
-                pj := port(tag, p[j])
-                err := os.Link(pj, ij)
-                if err != nil {
-                    // one reason this link can fail is if the
-                    // corresponding Paxos peer has prematurely quit and
-                    // deleted its socket file (e.g., called px.Kill()).
-                    t.Fatalf("os.Link(%v, %v): %v\n", pj, ij, err)
-                }
-            }
+            groups[pi] = append(groups[pi], port(tag, p[i]))
         }
     }
+    faults.Partition(tag, groups...)
 }
 
-func testPartition(t *testing.T) {
+func TestPartition(t *testing.T) {
     runtime.GOMAXPROCS(4)
 
     tag := "partition"
     const npaxos = 5
     var pxa []*Paxos = make([]*Paxos, npaxos)
     defer cleanup(pxa)
-    defer cleanpp(tag, npaxos)
+    defer faults.Heal(tag)
 
+    var pxh []string = make([]string, npaxos)
     for i := 0; i < npaxos; i++ {
-        var pxh []string = make([]string, npaxos)
-        for j := 0; j < npaxos; j++ {
-            if j == i {
-                pxh[j] = port(tag, i)
-            } else {
-                pxh[j] = pp(tag, i, j)
-            }
-        }
-        pxa[i] = Make(pxh, i, nil)
+        pxh[i] = port(tag, i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makeFaultyPaxos(pxh, i)
     }
-    defer part(t, tag, npaxos, []int{}, []int{}, []int{})
 
     seq := 0
 /*
@@ -741,7 +730,7 @@ func testPartition(t *testing.T) {
         seq++
 
         for i := 0; i < npaxos; i++ {
-            pxa[i].unreliable = true
+            pxa[i].SetUnreliable(true)
         }
 
         part(t, tag, npaxos, []int{0,1,2}, []int{3,4}, []int{})
@@ -756,7 +745,7 @@ func testPartition(t *testing.T) {
         part(t, tag, npaxos, []int{0,1}, []int{2,3,4}, []int{})
 
         for i := 0; i < npaxos; i++ {
-            pxa[i].unreliable = false
+            pxa[i].SetUnreliable(false)
         }
 
         waitn(t, pxa, seq, 5)
@@ -774,21 +763,16 @@ func testLots(t *testing.T) {
     const npaxos = 5
     var pxa []*Paxos = make([]*Paxos, npaxos)
     defer cleanup(pxa)
-    defer cleanpp(tag, npaxos)
+    defer faults.Heal(tag)
 
+    var pxh []string = make([]string, npaxos)
     for i := 0; i < npaxos; i++ {
-        var pxh []string = make([]string, npaxos)
-        for j := 0; j < npaxos; j++ {
-            if j == i {
-                pxh[j] = port(tag, i)
-            } else {
-                pxh[j] = pp(tag, i, j)
-            }
-        }
-        pxa[i] = Make(pxh, i, nil)
-        pxa[i].unreliable = true
+        pxh[i] = port(tag, i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makeFaultyPaxos(pxh, i)
+        pxa[i].SetUnreliable(true)
     }
-    defer part(t, tag, npaxos, []int{}, []int{}, []int{})
 
     done := false
 
@@ -859,7 +843,7 @@ func testLots(t *testing.T) {
 
     // repair, then check that all instances decided.
     for i := 0; i < npaxos; i++ {
-        pxa[i].unreliable = false
+        pxa[i].SetUnreliable(false)
     }
     part(t, tag, npaxos, []int{0,1,2,3,4}, []int{}, []int{})
     time.Sleep(5 * time.Second)
@@ -870,3 +854,975 @@ func testLots(t *testing.T) {
 
     fmt.Printf("  ... Passed\n")
 }
+
+//
+// a durable peer remembers its promises and decisions
+// across a restart.
+//
+func TestPersistence(t *testing.T) {
+    fmt.Printf("Test: Acceptor state survives restart ...\n")
+
+    dir, err := ioutil.TempDir("", "paxos")
+    if err != nil {
+        t.Fatalf("TempDir: %v", err)
+    }
+    defer os.RemoveAll(dir)
+
+    pxh := []string{port("persist", 0)}
+    pxa := []*Paxos{MakeWithDir(pxh, 0, rpc.NewServer(), dir)}
+
+    pxa[0].Start(0, "hello")
+    pxa[0].Start(3, "bye")
+    waitn(t, pxa, 0, 1)
+    waitn(t, pxa, 3, 1)
+
+    preply := &PrepareReplys{}
+    pxa[0].HandlePrepare(PrepareArgs{1, paxosutility.Ballot{Round: 5}, -1, 0}, preply)
+    areply := &AcceptReplys{}
+    pxa[0].HandleAccept(AcceptArgs{2, paxosutility.Ballot{Round: 5}, "x", -1, 0}, areply)
+    if !preply.Ok || !areply.Ok {
+        t.Fatalf("durable peer rejected a fresh ballot")
+    }
+    pxa[0].Done(0)
+
+    pxa[0].Kill()
+    pxa[0] = MakeWithDir(pxh, 0, rpc.NewServer(), dir)
+    defer cleanup(pxa)
+
+    if fate, v := pxa[0].Status(3); fate != Decided || v != "bye" {
+        t.Fatalf("decision lost after restart; fate=%v v=%v", fate, v)
+    }
+    if pxa[0].Min() != 1 {
+        t.Fatalf("Done() lost after restart; Min()=%v", pxa[0].Min())
+    }
+    if pxa[0].Max() != 3 {
+        t.Fatalf("wrong Max() after restart %v", pxa[0].Max())
+    }
+
+    preply = &PrepareReplys{}
+    pxa[0].HandlePrepare(PrepareArgs{1, paxosutility.Ballot{Round: 3}, -1, 0}, preply)
+    if preply.Ok {
+        t.Fatalf("promise lost after restart")
+    }
+
+    preply = &PrepareReplys{}
+    pxa[0].HandlePrepare(PrepareArgs{2, paxosutility.Ballot{Round: 7}, -1, 0}, preply)
+    if !preply.Ok || preply.Na != (paxosutility.Ballot{Round: 5}) || preply.Va != "x" {
+        t.Fatalf("accepted value lost after restart; Na=%v Va=%v", preply.Na, preply.Va)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+//
+// the log of a durable peer drops the instances it
+// forgets while it runs.
+//
+func TestLogCompaction(t *testing.T) {
+    fmt.Printf("Test: Log is compacted when instances are forgotten ...\n")
+
+    const ninstances = 3 * compactInterval
+
+    dir, err := ioutil.TempDir("", "paxos")
+    if err != nil {
+        t.Fatalf("TempDir: %v", err)
+    }
+    defer os.RemoveAll(dir)
+
+    pxh := []string{port("compact", 0)}
+    pxa := []*Paxos{MakeWithDir(pxh, 0, rpc.NewServer(), dir)}
+
+    for seq := 0; seq < ninstances; seq++ {
+        pxa[0].Start(seq, seq)
+        waitn(t, pxa, seq, 1)
+    }
+    path := filepath.Join(dir, "paxos.log")
+    full, err := os.Stat(path)
+    if err != nil {
+        t.Fatalf("Stat: %v", err)
+    }
+
+    pxa[0].Done(ninstances - 2)
+    pxa[0].Start(ninstances, "last")
+    waitn(t, pxa, ninstances, 1)
+
+    for iters := 0; ; iters++ {
+        info, err := os.Stat(path)
+        if err != nil {
+            t.Fatalf("Stat: %v", err)
+        }
+        if info.Size() < full.Size() / 10 {
+            break
+        }
+        if iters >= 50 {
+            t.Fatalf("log not compacted; %v bytes, %v before Done()", info.Size(), full.Size())
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+
+    pxa[0].Kill()
+    pxa[0] = MakeWithDir(pxh, 0, rpc.NewServer(), dir)
+    defer cleanup(pxa)
+
+    if pxa[0].Min() != ninstances - 1 {
+        t.Fatalf("Done() lost after compaction; Min()=%v", pxa[0].Min())
+    }
+    for seq := ninstances - 1; seq <= ninstances; seq++ {
+        if fate, _ := pxa[0].Status(seq); fate != Decided {
+            t.Fatalf("decision %v lost after compaction; fate=%v", seq, fate)
+        }
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestLeader(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("leader", i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makePaxos(pxh, i)
+        pxa[i].SetLeaderMode(true)
+    }
+
+    fmt.Printf("Test: Leader, many proposers ...\n")
+
+    for i := 0; i < npaxos; i++ {
+        pxa[i].Start(0, 100 + i)
+    }
+    waitn(t, pxa, 0, npaxos)
+    for seq := 1; seq < 10; seq++ {
+        pxa[seq % npaxos].Start(seq, seq)
+        waitn(t, pxa, seq, npaxos)
+    }
+
+    fmt.Printf("  ... Passed\n")
+
+    fmt.Printf("Test: Leader skips prepare ...\n")
+
+    leader := -1
+    for i := 0; i < npaxos; i++ {
+        if _, leading := pxa[i].leadership(); leading {
+            leader = i
+        }
+    }
+    if leader < 0 {
+        t.Fatalf("no leader")
+    }
+
+    time.Sleep(1 * time.Second)
+    total1 := 0
+    for j := 0; j < npaxos; j++ {
+        total1 += int(atomic.LoadInt64(&pxa[j].rpcCount))
+    }
+
+    const ninst = 5
+    for seq := 10; seq < 10 + ninst; seq++ {
+        pxa[leader].Start(seq, seq)
+        waitn(t, pxa, seq, npaxos)
+    }
+
+    time.Sleep(1 * time.Second)
+    total2 := 0
+    for j := 0; j < npaxos; j++ {
+        total2 += int(atomic.LoadInt64(&pxa[j].rpcCount))
+    }
+
+    // per agreement: 2 accepts, 2 decides
+    expected := ninst * (npaxos - 1) * 2
+    if total2 - total1 > expected {
+        t.Fatalf("too many RPCs with a stable leader; got %v, expected %v", total2 - total1, expected)
+    }
+
+    fmt.Printf("  ... Passed\n")
+
+    fmt.Printf("Test: Leader failover ...\n")
+
+    pxa[leader].Kill()
+    pxa[leader] = nil
+
+    for seq := 20; seq < 25; seq++ {
+        pxa[(leader + 1) % npaxos].Start(seq, seq)
+        waitn(t, pxa, seq, npaxos - 1)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func tcpport() string {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return ""
+    }
+    defer l.Close()
+    return l.Addr().String()
+}
+
+//
+// the TCP transport keeps its connections, and
+// reconnects to a restarted peer.
+//
+func TestTCPTransport(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: TCP transport reconnects ...\n")
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = tcpport()
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = Make(pxh, i, nil)
+    }
+
+    for seq := 0; seq < 5; seq++ {
+        pxa[seq % npaxos].Start(seq, seq)
+        waitn(t, pxa, seq, npaxos)
+    }
+
+    pxa[2].Kill()
+    pxa[2] = Make(pxh, 2, nil)
+
+    for seq := 5; seq < 10; seq++ {
+        pxa[0].Start(seq, seq)
+        waitn(t, pxa, seq, npaxos)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+//
+// a peer that never answers must not stall the
+// rounds of the others.
+//
+func TestSlowPeer(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Unresponsive peer does not stall rounds ...\n")
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("slow", i)
+    }
+    for i := 0; i < npaxos - 1; i++ {
+        pxa[i] = makePaxos(pxh, i)
+    }
+
+    // the last peer listens, but never accepts a connection
+    l, err := network.listen(pxh[npaxos - 1])
+    if err != nil {
+        t.Fatalf("listen: %v", err)
+    }
+    defer l.Close()
+
+    for seq := 0; seq < 5; seq++ {
+        pxa[seq % (npaxos - 1)].Start(seq, seq)
+        waitn(t, pxa, seq, npaxos - 1)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+//
+// an RPC to a peer that accepts the connection but never
+// answers times out, and Kill() stops the ones in flight.
+//
+func TestRPCDeadline(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: RPCs to a silent peer time out ...\n")
+
+    pxh := []string{port("deadline", 0), port("deadline", 1)}
+    l, err := network.listen(pxh[1])
+    if err != nil {
+        t.Fatalf("listen: %v", err)
+    }
+    defer l.Close()
+    go func() {
+        for {
+            if _, err := l.Accept(); err != nil {
+                return
+            }
+        }
+    }()
+
+    px := makePaxos(pxh, 0)
+    defer px.Kill()
+    px.SetRPCTimeout(100 * time.Millisecond)
+
+    start := time.Now()
+    if px.call(px.ctx, 1, "Paxos.HandleDecide", DecideArgs{0, 0, -1, 0}, &DecideReplys{}) {
+        t.Fatalf("silent peer answered")
+    }
+    if d := time.Since(start); d > time.Second {
+        t.Fatalf("RPC did not time out; took %v", d)
+    }
+
+    // Without a deadline, only Kill() stops the RPC
+    px.SetRPCTimeout(time.Hour)
+    done := make(chan bool)
+    go func() {
+        done <- px.call(px.ctx, 1, "Paxos.HandleDecide", DecideArgs{0, 0, -1, 0}, &DecideReplys{})
+    }()
+    time.Sleep(100 * time.Millisecond)
+    px.Kill()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatalf("Kill() did not stop the RPC")
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+//
+// An unreliable peer loses RPCs one by one, even though the connections
+// are kept open across RPCs
+//
+func TestUnreliablePerRPC(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Unreliable peer loses single RPCs ...\n")
+
+    const ncalls = 300
+
+    pxh := []string{port("perrpc", 0), port("perrpc", 1)}
+    pxa := []*Paxos{makePaxos(pxh, 0), makePaxos(pxh, 1)}
+    defer cleanup(pxa)
+    pxa[1].SetUnreliable(true)
+
+    ok := 0
+    for i := 0; i < ncalls; i++ {
+        if pxa[0].call(pxa[0].ctx, 1, "Paxos.HandleDecide", DecideArgs{0, 0, -1, 0}, &DecideReplys{}) {
+            ok++
+        }
+    }
+    // About 10% of the requests and 18% of the replies are lost
+    if ok < ncalls / 2 || ok > ncalls * 9 / 10 {
+        t.Fatalf("wrong number of RPCs through; got %v of %v", ok, ncalls)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+//
+// Kill() returns once the goroutines of the peer have
+// exited, even while its proposers are stuck.
+//
+func TestKill(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Kill waits for the goroutines ...\n")
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("kill", i)
+    }
+    before := runtime.NumGoroutine()
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makePaxos(pxh, i)
+    }
+
+    for seq := 0; seq < 5; seq++ {
+        pxa[0].Start(seq, seq)
+    }
+    waitn(t, pxa, 4, npaxos)
+
+    // without a majority, the proposers keep trying
+    pxa[1].Kill()
+    pxa[2].Kill()
+    for seq := 5; seq < 10; seq++ {
+        pxa[0].Start(seq, seq)
+    }
+    pxa[0].Subscribe(0)
+    time.Sleep(300 * time.Millisecond)
+
+    start := time.Now()
+    pxa[0].Kill()
+    if d := time.Since(start); d > 2 * time.Second {
+        t.Fatalf("Kill() took %v", d)
+    }
+
+    // only the goroutines of net/rpc may still be finishing
+    time.Sleep(100 * time.Millisecond)
+    if after := runtime.NumGoroutine(); after > before + 2 {
+        t.Fatalf("%v goroutines left running", after - before)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+//
+// A proposer started with StartContext exits once its context
+// is canceled, even without a majority.
+//
+func TestStartContext(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: StartContext proposer exits when canceled ...\n")
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("startctx", i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makePaxos(pxh, i)
+    }
+    pxa[1].Kill()
+    pxa[2].Kill()
+
+    time.Sleep(100 * time.Millisecond)
+    before := runtime.NumGoroutine()
+
+    // without a majority, the proposers keep trying until canceled
+    ctx, cancel := context.WithCancel(context.Background())
+    for seq := 0; seq < 5; seq++ {
+        pxa[0].StartContext(ctx, seq, seq)
+    }
+    time.Sleep(300 * time.Millisecond)
+    if running := runtime.NumGoroutine(); running < before + 5 {
+        t.Fatalf("proposers exited before the cancel; %v goroutines, %v before", running, before)
+    }
+
+    cancel()
+    time.Sleep(500 * time.Millisecond)
+    if after := runtime.NumGoroutine(); after > before + 2 {
+        t.Fatalf("%v goroutines left running after the cancel", after - before)
+    }
+    for seq := 0; seq < 5; seq++ {
+        if fate, _ := pxa[0].Status(seq); fate != Pending {
+            t.Fatalf("instance %v is %v; wanted Pending", seq, fate)
+        }
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestStatus(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Status tells pending, decided and forgotten ...\n")
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("status", i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makePaxos(pxh, i)
+    }
+
+    if fate, _ := pxa[0].Status(0); fate != Pending {
+        t.Fatalf("fresh instance is %v; wanted Pending", fate)
+    }
+    pxa[0].Start(0, "x")
+    waitn(t, pxa, 0, npaxos)
+    if fate, v := pxa[1].Status(0); fate != Decided || v != "x" {
+        t.Fatalf("decided instance is %v %v; wanted Decided x", fate, v)
+    }
+
+    for i := 0; i < npaxos; i++ {
+        pxa[i].Done(0)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i].Start(1 + i, i)
+    }
+    for i := 0; i < npaxos; i++ {
+        waitn(t, pxa, 1 + i, npaxos)
+    }
+    for iters := 0; iters < 20 && pxa[1].Min() == 0; iters++ {
+        time.Sleep(100 * time.Millisecond)
+    }
+    if fate, _ := pxa[1].Status(0); fate != Forgotten {
+        t.Fatalf("instance below Min() is %v; wanted Forgotten", fate)
+    }
+
+    pxa[2].Kill()
+    if fate, _ := pxa[2].Status(1); fate != Pending {
+        t.Fatalf("dead peer reports %v; wanted Pending", fate)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestSubscribe(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Subscribers get decisions in order ...\n")
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("subscribe", i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makePaxos(pxh, i)
+    }
+
+    ch := pxa[1].Subscribe(2)
+
+    const ninst = 10
+    for _, seq := range rand.Perm(ninst) {
+        pxa[seq % npaxos].Start(seq, seq * 10)
+    }
+
+    for seq := 2; seq < ninst; seq++ {
+        select {
+        case d := <-ch:
+            if d.Seq != seq || d.Value != seq * 10 {
+                t.Fatalf("wrong decision; got %v=%v, expected %v=%v", d.Seq, d.Value, seq, seq * 10)
+            }
+        case <-time.After(10 * time.Second):
+            t.Fatalf("no decision for %v", seq)
+        }
+    }
+
+    pxa[1].Kill()
+    select {
+    case _, ok := <-ch:
+        if ok {
+            t.Fatalf("decision after Kill()")
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatalf("channel not closed by Kill()")
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+//
+// a restarted peer that lost the forgotten instances
+// gets a snapshot instead of proposing into them.
+//
+func TestSnapshotInstall(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Snapshot for a peer behind forgotten instances ...\n")
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("snapshot", i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makePaxos(pxh, i)
+    }
+
+    for seq := 0; seq <= 10; seq++ {
+        pxa[0].Start(seq, seq)
+        waitn(t, pxa, seq, npaxos)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i].Snapshot(9, []byte("state9"))
+        pxa[i].Done(9)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i].Start(11 + i, 11 + i)
+        waitn(t, pxa, 11 + i, npaxos)
+    }
+    for i := 0; i < npaxos; i++ {
+        for iters := 0; iters < 50 && pxa[i].Min() != 10; iters++ {
+            time.Sleep(100 * time.Millisecond)
+        }
+        if pxa[i].Min() != 10 {
+            t.Fatalf("Min() did not advance; got %v", pxa[i].Min())
+        }
+    }
+
+    // restart with every instance lost
+    pxa[2].Kill()
+    pxa[2] = makePaxos(pxh, 2)
+    ch := pxa[2].Subscribe(0)
+    pxa[2].Start(0, "bad")
+
+    select {
+    case d := <-ch:
+        data, _ := d.Value.([]byte)
+        if !d.Snapshot || d.Seq != 9 || string(data) != "state9" {
+            t.Fatalf("expected the snapshot; got %v", d)
+        }
+    case <-time.After(10 * time.Second):
+        t.Fatalf("no snapshot installed")
+    }
+    if fate, _ := pxa[2].Status(0); fate != Forgotten {
+        t.Fatalf("instance covered by the snapshot is %v; wanted Forgotten", fate)
+    }
+
+    pxa[2].Start(10, "bad")
+    select {
+    case d := <-ch:
+        if d.Snapshot || d.Seq != 10 || d.Value != 10 {
+            t.Fatalf("expected instance 10; got %v", d)
+        }
+    case <-time.After(10 * time.Second):
+        t.Fatalf("instance after the snapshot not delivered")
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestForgetDeadPeer(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Forgetting does not wait for a dead peer ...\n")
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("forgetdead", i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makePaxos(pxh, i)
+        pxa[i].SetForgetPolicy(ForgetMajority)
+    }
+    pxa[2].Kill()
+
+    for seq := 0; seq < 10; seq++ {
+        pxa[0].Start(seq, seq)
+        waitmajority(t, pxa, seq)
+    }
+
+    // nothing is forgotten before a snapshot covers it
+    pxa[0].Done(9)
+    pxa[1].Done(9)
+    pxa[0].Start(10, 10)
+    pxa[1].Start(11, 11)
+    waitmajority(t, pxa, 11)
+    if pxa[0].Min() != 0 || pxa[1].Min() != 0 {
+        t.Fatalf("forgot without a snapshot")
+    }
+
+    pxa[0].Snapshot(9, []byte("state9"))
+    pxa[1].Snapshot(9, []byte("state9"))
+    for i := 0; i < 2; i++ {
+        if pxa[i].Min() != 10 {
+            t.Fatalf("Min() did not advance without the dead peer; got %v", pxa[i].Min())
+        }
+    }
+
+    pxa[2] = makePaxos(pxh, 2)
+    pxa[2].SetForgetPolicy(ForgetMajority)
+    ch := pxa[2].Subscribe(0)
+    pxa[2].Start(0, "bad")
+
+    // a late broadcast may still teach it the first instances
+    for caught := false; !caught; {
+        select {
+        case d := <-ch:
+            if d.Snapshot {
+                if d.Seq != 9 {
+                    t.Fatalf("expected the snapshot of 9; got %v", d)
+                }
+                caught = true
+            } else if d.Value != d.Seq {
+                t.Fatalf("expected the snapshot; got %v", d)
+            }
+        case <-time.After(10 * time.Second):
+            t.Fatalf("dead peer not caught up")
+        }
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestReconfig(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Replace a peer with a new one ...\n")
+
+    const npaxos = 4
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("reconfig", i)
+    }
+    first := []string{pxh[0], pxh[1], pxh[2], ""}
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = MakeReconfigurable(pxh, first, 3, i, nil, "", network.Transport())
+    }
+
+    for seq := 0; seq < 3; seq++ {
+        pxa[0].Start(seq, seq)
+        waitn(t, pxa, seq, 3)
+    }
+    if fate, _ := pxa[3].Status(2); fate == Decided {
+        t.Fatalf("a peer out of the group took part")
+    }
+
+    // instances from 6 on are decided by 0, 1 and 3
+    pxa[0].Start(3, Reconfig{[]string{pxh[0], pxh[1], "", pxh[3]}})
+    for iters := 0; iters < 50; iters++ {
+        if fate, _ := pxa[3].Status(3); fate == Decided {
+            break
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    if configs := pxa[3].Configs(); len(configs) != 2 || configs[1].Start != 6 {
+        t.Fatalf("new peer did not learn the configuration; got %v", configs)
+    }
+    for seq := 4; seq < 6; seq++ {
+        pxa[0].Start(seq, seq)
+        waitn(t, pxa[:3], seq, 2)
+    }
+
+    pxa[1].Kill()
+    pxa[2].Kill()
+    pxa[0].Start(6, 6)
+    waitn(t, []*Paxos{pxa[0], pxa[3]}, 6, 2)
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestFaults(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Lost, late and reordered RPCs ...\n")
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+    defer faults.Reset()
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("faults", i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makeFaultyPaxos(pxh, i)
+    }
+
+    faults.SetDrop(0.1)
+    faults.SetDropReply(0.1)
+    faults.SetDelay(5 * time.Millisecond)
+    faults.SetReorder(0.2, 50 * time.Millisecond)
+
+    const ninst = 20
+    for seq := 0; seq < ninst; seq++ {
+        for i := 0; i < npaxos; i++ {
+            pxa[i].Start(seq, (seq * 10) + i)
+        }
+    }
+    for seq := 0; seq < ninst; seq++ {
+        waitmajority(t, pxa, seq)
+    }
+
+    faults.Reset()
+    for seq := 0; seq < ninst; seq++ {
+        waitn(t, pxa, seq, npaxos)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestRejectionHint(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Refusals carry the highest round promised ...\n")
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("hint", i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makePaxos(pxh, i)
+    }
+
+    // Peer 0 promises a high ballot of peer 2
+    high := paxosutility.Ballot{Round: 100, NodeID: 2}
+    prep := &PrepareReplys{}
+    pxa[0].HandlePrepare(PrepareArgs{0, high, -1, 2}, prep)
+    if !prep.Ok {
+        t.Fatalf("high ballot refused")
+    }
+
+    prep = &PrepareReplys{}
+    pxa[0].HandlePrepare(PrepareArgs{0, paxosutility.Ballot{Round: 1, NodeID: 1}, -1, 1}, prep)
+    if prep.Ok || prep.Np != high {
+        t.Fatalf("prepare refused with Ok=%v Np=%v; wanted Np=%v", prep.Ok, prep.Np, high)
+    }
+    acc := &AcceptReplys{}
+    pxa[0].HandleAccept(AcceptArgs{0, paxosutility.Ballot{Round: 1, NodeID: 1}, 1, -1, 1}, acc)
+    if acc.Ok || acc.Np != high {
+        t.Fatalf("accept refused with Ok=%v Np=%v; wanted Np=%v", acc.Ok, acc.Np, high)
+    }
+
+    // A proposer that only knows low rounds still decides
+    pxa[1].Start(0, "x")
+    waitn(t, pxa, 0, npaxos)
+
+    fmt.Printf("  ... Passed\n")
+}
+
+func TestContention(t *testing.T) {
+    runtime.GOMAXPROCS(4)
+
+    fmt.Printf("Test: Duelling proposers back off ...\n")
+
+    const npaxos = 5
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = port("contention", i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = makePaxos(pxh, i)
+    }
+
+    // Every peer proposes every instance at once
+    const ninst = 20
+    start := time.Now()
+    for seq := 0; seq < ninst; seq++ {
+        for i := 0; i < npaxos; i++ {
+            pxa[i].Start(seq, (seq * 10) + i)
+        }
+    }
+    for seq := 0; seq < ninst; seq++ {
+        waitn(t, pxa, seq, npaxos)
+    }
+    if d := time.Since(start); d > 2 * time.Second {
+        t.Fatalf("too slow to resolve the contention; took %v", d)
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
+
+//
+// randomized schedules of Start, Kill and partitions on a
+// virtual clock. a failure is reproduced by runSimulation
+// with the seed it reports.
+//
+func runSimulation(t *testing.T, seed int64) {
+    const npaxos = 5
+    const ninst = 10
+    sim := NewSim(seed)
+    r := sim.Rand()
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    defer cleanup(pxa)
+
+    for i := 0; i < npaxos; i++ {
+        pxh[i] = fmt.Sprintf("sim-%v", i)
+    }
+    for i := 0; i < npaxos; i++ {
+        pxa[i] = sim.Make(pxh, i)
+    }
+    sim.SetDrop(r.Float64() * 0.3)
+    sim.SetDelay(time.Duration(1 + r.Intn(50)) * time.Millisecond)
+
+    // at most a minority is killed
+    dead := make([]bool, npaxos)
+    ndead := 0
+    for at := time.Duration(0); at < 10 * time.Second; at += time.Duration(r.Intn(500)) * time.Millisecond {
+        switch op := r.Intn(10); {
+        case op < 6:
+            i, seq, v := r.Intn(npaxos), r.Intn(ninst), r.Int()
+            sim.At(at, func() { pxa[i].Start(seq, v) })
+        case op < 7:
+            i := r.Intn(npaxos)
+            if !dead[i] && ndead + ndead + 2 < npaxos {
+                dead[i] = true
+                ndead++
+                sim.At(at, func() { pxa[i].Kill() })
+            }
+        case op < 9:
+            groups := make([][]string, 3)
+            for i := 0; i < npaxos; i++ {
+                g := r.Intn(3)
+                groups[g] = append(groups[g], pxh[i])
+            }
+            sim.At(at, func() { sim.Partition(groups...) })
+        default:
+            sim.At(at, func() { sim.Partition() })
+        }
+    }
+    sim.Run(10 * time.Second)
+
+    // heal, and every instance must be decided by the live peers
+    sim.Partition()
+    sim.SetDrop(0)
+    for seq := 0; seq < ninst; seq++ {
+        for i := 0; i < npaxos; i++ {
+            if !dead[i] {
+                pxa[i].Start(seq, -1)
+            }
+        }
+    }
+    sim.Run(20 * time.Second)
+
+    for seq := 0; seq < ninst; seq++ {
+        var v interface{}
+        for i := 0; i < npaxos; i++ {
+            fate, v1 := pxa[i].Status(seq)
+            if fate != Decided && !dead[i] {
+                t.Fatalf("seed %v: instance %v not decided at peer %v", seed, seq, i)
+            }
+            if fate == Decided && v != nil && v != v1 {
+                t.Fatalf("seed %v: decided values do not match; seq=%v v=%v v1=%v", seed, seq, v, v1)
+            }
+            if fate == Decided {
+                v = v1
+            }
+        }
+    }
+}
+
+// go test -run Simulation -args -simseeds 5000
+var simSeeds = flag.Int("simseeds", 50, "number of simulated schedules")
+var simSeed = flag.Int64("simseed", -1, "run only the simulated schedule of this seed")
+
+func TestSimulation(t *testing.T) {
+    fmt.Printf("Test: Randomized schedules on a virtual clock ...\n")
+
+    if *simSeed >= 0 {
+        runSimulation(t, *simSeed)
+    } else {
+        for seed := int64(0); seed < int64(*simSeeds); seed++ {
+            runSimulation(t, seed)
+        }
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,292 @@
+package paxosutility
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/gob"
+    "errors"
+    "hash/crc32"
+    "io"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+const (
+    RecordAcceptor = iota   // Np, Na, Va of instance Seq
+    RecordDecided           // Va is the decided value of instance Seq
+    RecordDone              // Seq is the argument of the local Done()
+    RecordForget            // Seq is the bound below which everything is forgotten
+    RecordBallot            // Np is promised to a leader for every instance
+    RecordConfig            // Va is the configuration of the instances from Seq on
+)
+
+type LogRecord struct {
+    Type int
+    Seq int
+    Np Ballot
+    Na Ballot
+    Va interface{}
+}
+
+var ErrLogClosed = errors.New("paxos log closed")
+
+//--------------------------------------------------//
+
+// Write-ahead log of a paxos peer
+// Each record is stored as: length (4 bytes) | crc32 (4 bytes) | gob data
+
+type PaxosLog struct {
+    path string
+    file *os.File
+    tail [][]byte   // the records appended during Compact, nil otherwise
+    lock sync.Mutex
+    compactlock sync.Mutex
+}
+
+func OpenPaxosLog(dir string) (*PaxosLog, []LogRecord, error) {
+    err := os.MkdirAll(dir, 0755)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    path := filepath.Join(dir, "paxos.log")
+    file, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    records, size, err := readRecords(file)
+    if err != nil {
+        file.Close()
+        return nil, nil, err
+    }
+
+    // Drop the torn record left by a crash in the middle of a write
+    err = file.Truncate(size)
+    if err != nil {
+        file.Close()
+        return nil, nil, err
+    }
+    return &PaxosLog{path, file, nil, sync.Mutex{}, sync.Mutex{}}, records, nil
+}
+
+func readRecords(r io.Reader) ([]LogRecord, int64, error) {
+    records := make([]LogRecord, 0)
+    size := int64(0)
+    header := make([]byte, 8)
+    for {
+        if _, err := io.ReadFull(r, header); err != nil {
+            break
+        }
+        body := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+        if _, err := io.ReadFull(r, body); err != nil {
+            break
+        }
+        if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+            break
+        }
+
+        // A complete record that cannot be decoded is not a torn write
+        rec := LogRecord{}
+        if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&rec); err != nil {
+            return nil, 0, err
+        }
+        records = append(records, rec)
+        size += int64(len(header) + len(body))
+    }
+    return records, size, nil
+}
+
+func encodeRecord(rec LogRecord) ([]byte, error) {
+    body := bytes.Buffer{}
+    if err := gob.NewEncoder(&body).Encode(rec); err != nil {
+        return nil, err
+    }
+    buf := make([]byte, 8, 8 + body.Len())
+    binary.BigEndian.PutUint32(buf[0:4], uint32(body.Len()))
+    binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body.Bytes()))
+    return append(buf, body.Bytes()...), nil
+}
+
+// Make a rename of path durable
+func syncDir(path string) {
+    if dir, err := os.Open(filepath.Dir(path)); err == nil {
+        dir.Sync()
+        dir.Close()
+    }
+}
+
+// Append a record, and fsync it before returning if sync is true
+func (log *PaxosLog) Append(rec LogRecord, sync bool) error {
+    buf, err := encodeRecord(rec)
+    if err != nil {
+        return err
+    }
+
+    log.lock.Lock()
+    defer log.lock.Unlock()
+
+    if log.file == nil {
+        return ErrLogClosed
+    }
+    if _, err := log.file.Write(buf); err != nil {
+        return err
+    }
+    if log.tail != nil {
+        log.tail = append(log.tail, buf)
+    }
+    if sync {
+        return log.file.Sync()
+    }
+    return nil
+}
+
+// Atomically replace the whole log with records
+func (log *PaxosLog) Rewrite(records []LogRecord) error {
+    log.lock.Lock()
+    defer log.lock.Unlock()
+
+    if log.file == nil {
+        return ErrLogClosed
+    }
+    return log.rewrite(records, nil)
+}
+
+// Atomically replace the whole log with the records build returns, while
+// the log is appended to
+// build runs without the lock, so it may wait for the writers. The records
+// appended meanwhile are kept after its records, as they may be newer.
+func (log *PaxosLog) Compact(build func() []LogRecord) error {
+    log.compactlock.Lock()
+    defer log.compactlock.Unlock()
+
+    log.lock.Lock()
+    if log.file == nil {
+        log.lock.Unlock()
+        return ErrLogClosed
+    }
+    log.tail = make([][]byte, 0)
+    log.lock.Unlock()
+
+    records := build()
+
+    log.lock.Lock()
+    defer log.lock.Unlock()
+
+    tail := log.tail
+    log.tail = nil
+    if log.file == nil {
+        return ErrLogClosed
+    }
+    return log.rewrite(records, tail)
+}
+
+// Must hold log.lock
+func (log *PaxosLog) rewrite(records []LogRecord, tail [][]byte) error {
+    tmp, err := os.Create(log.path + ".tmp")
+    if err != nil {
+        return err
+    }
+    for _, rec := range records {
+        buf, err := encodeRecord(rec)
+        if err == nil {
+            _, err = tmp.Write(buf)
+        }
+        if err != nil {
+            tmp.Close()
+            return err
+        }
+    }
+    for _, buf := range tail {
+        if _, err := tmp.Write(buf); err != nil {
+            tmp.Close()
+            return err
+        }
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    tmp.Close()
+
+    if err := os.Rename(log.path + ".tmp", log.path); err != nil {
+        return err
+    }
+    syncDir(log.path)
+
+    file, err := os.OpenFile(log.path, os.O_RDWR | os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    log.file.Close()
+    log.file = file
+    return nil
+}
+
+//--------------------------------------------------//
+
+// Snapshot of the application, kept next to the log
+
+type Snapshot struct {
+    Seq int         // covers every instance <= Seq
+    Data []byte
+}
+
+func (log *PaxosLog) snapshotPath() string {
+    return filepath.Join(filepath.Dir(log.path), "snapshot")
+}
+
+// Returns a snapshot with Seq -1 if there is none
+func (log *PaxosLog) ReadSnapshot() (Snapshot, error) {
+    snap := Snapshot{-1, nil}
+    file, err := os.Open(log.snapshotPath())
+    if os.IsNotExist(err) {
+        return snap, nil
+    } else if err != nil {
+        return snap, err
+    }
+    defer file.Close()
+
+    err = gob.NewDecoder(file).Decode(&snap)
+    return snap, err
+}
+
+// Atomically replace the snapshot
+func (log *PaxosLog) WriteSnapshot(snap Snapshot) error {
+    log.lock.Lock()
+    defer log.lock.Unlock()
+
+    if log.file == nil {
+        return ErrLogClosed
+    }
+
+    path := log.snapshotPath()
+    tmp, err := os.Create(path + ".tmp")
+    if err != nil {
+        return err
+    }
+    err = gob.NewEncoder(tmp).Encode(snap)
+    if err == nil {
+        err = tmp.Sync()
+    }
+    tmp.Close()
+    if err != nil {
+        return err
+    }
+    if err := os.Rename(path + ".tmp", path); err != nil {
+        return err
+    }
+    syncDir(path)
+    return nil
+}
+
+func (log *PaxosLog) Close() {
+    log.lock.Lock()
+    defer log.lock.Unlock()
+
+    if log.file != nil {
+        log.file.Close()
+        log.file = nil
+    }
+}
@@ -5,106 +5,104 @@ import (
     "sync/atomic"
 )
 
+// Ballots are ordered by Round, then by NodeID, so that two peers never
+// propose with the same ballot, whatever the membership
+// The zero Ballot is lower than any ballot a peer proposes with.
+type Ballot struct {
+    Round int
+    NodeID int
+}
+
+func (b Ballot) Less(c Ballot) bool {
+    return b.Round < c.Round || (b.Round == c.Round && b.NodeID < c.NodeID)
+}
+
+func (b Ballot) IsZero() bool {
+    return b == Ballot{}
+}
+
+// The smallest ballot of node id higher than b
+func (b Ballot) Next(id int) Ballot {
+    if b.NodeID < id {
+        return Ballot{b.Round, id}
+    }
+    return Ballot{b.Round + 1, id}
+}
+
+//--------------------------------------------------//
+
 type PaxosData struct {
     Lock sync.Mutex
-    Np atomic.Value
-    Na atomic.Value
+    Np atomic.Value     // Ballot
+    Na atomic.Value     // Ballot
     Va atomic.Value
 }
 
 func NewPaxosData() *PaxosData {
     data := &PaxosData{sync.Mutex{}, atomic.Value{}, atomic.Value{}, atomic.Value{}}
-    data.Np.Store(-1)
-    data.Na.Store(-1)
+    data.Np.Store(Ballot{})
+    data.Na.Store(Ballot{})
     return data
 }
 
 //--------------------------------------------------//
 
+// Acceptor state of the instances
+
 type PaxosAllocator struct {
-    data map[int](*PaxosData)
-    bound int
-    lock sync.Mutex
+    store *InstanceStore
 }
 
 func NewPaxosAllocator() *PaxosAllocator {
-    return &PaxosAllocator{make(map[int](*PaxosData)), -1, sync.Mutex{}}
+    return &PaxosAllocator{NewInstanceStore()}
 }
 
+// Returns nil if seq <= bound, as the instance is already forgotten
 func (alloc *PaxosAllocator) Create(seq int) (*PaxosData) {
-    alloc.lock.Lock()
-    defer alloc.lock.Unlock()
-
-    if seq <= alloc.bound {
+    data, ok := alloc.store.GetOrCreate(seq, func() interface{} {
         return NewPaxosData()
+    })
+    if !ok {
+        return nil
     }
-    val, exist := alloc.data[seq]
-    if exist {
-        return val
-    } else {
-        tmp := NewPaxosData()
-        alloc.data[seq] = tmp
-        return tmp
-    }
+    return data.(*PaxosData)
 }
 
 func (alloc *PaxosAllocator) Done(newbound int) {
-    alloc.lock.Lock()
-    defer alloc.lock.Unlock()
-
-    if newbound > alloc.bound {
-        for seq, _ := range(alloc.data) {
-            if seq <= newbound {
-                delete(alloc.data, seq)
-            }
-        }
-        alloc.bound = newbound
-    }
+    alloc.store.Truncate(newbound)
+}
+
+func (alloc *PaxosAllocator) Range(f func(seq int, data *PaxosData)) {
+    alloc.store.Range(func(seq int, data interface{}) {
+        f(seq, data.(*PaxosData))
+    })
 }
 
 //--------------------------------------------------//
 
+// Decided values of the instances
+
 type PaxosResult struct {
-    data map[int]interface{}
-    bound int
-    lock sync.Mutex
+    store *InstanceStore
 }
 
 func NewPaxosResult() *PaxosResult {
-    return &PaxosResult{make(map[int]interface{}), -1, sync.Mutex{}}
+    return &PaxosResult{NewInstanceStore()}
 }
 
 func (result *PaxosResult) Read(seq int) (bool, interface{}) {
-    result.lock.Lock()
-    defer result.lock.Unlock()
-
-    val, exist := result.data[seq]
-    if exist {
-        return true, val
-    } else {
-        return false, nil
-    }
+    v, exist := result.store.Get(seq)
+    return exist, v
 }
 
 func (result *PaxosResult) Write(seq int, v interface{}) {
-    result.lock.Lock()
-    defer result.lock.Unlock()
-
-    if seq > result.bound {
-        result.data[seq] = v
-    }
+    result.store.Put(seq, v)
 }
 
 func (result *PaxosResult) Done(newbound int) {
-    result.lock.Lock()
-    defer result.lock.Unlock()
-
-    if newbound > result.bound {
-        for seq, _ := range(result.data) {
-            if seq <= newbound {
-                delete(result.data, seq)
-            }
-        }
-        result.bound = newbound
-    }
+    result.store.Truncate(newbound)
+}
+
+func (result *PaxosResult) Range(f func(seq int, v interface{})) {
+    result.store.Range(f)
 }
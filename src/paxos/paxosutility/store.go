@@ -0,0 +1,180 @@
+package paxosutility
+
+import (
+    "sort"
+    "sync"
+)
+
+// Instance store
+// The instances are kept in segments of segmentSize consecutive instances.
+// Every segment has its own lock, so that different instances are read and
+// written concurrently, and forgetting a prefix drops whole segments.
+
+const segmentSize = 64
+
+type segment struct {
+    values [segmentSize]interface{}
+    used uint64     // bit i is set if values[i] is
+    lock sync.RWMutex
+}
+
+type InstanceStore struct {
+    segments map[int]*segment   // by seq / segmentSize
+    first int                   // no segment below it
+    bound int                   // every instance <= bound is forgotten
+    lock sync.RWMutex
+}
+
+func NewInstanceStore() *InstanceStore {
+    return &InstanceStore{make(map[int]*segment), 0, -1, sync.RWMutex{}}
+}
+
+// The segment of seq, created if create is true
+// Returns nil if seq <= bound, or if it does not exist
+func (st *InstanceStore) segment(seq int, create bool) *segment {
+    st.lock.RLock()
+    seg := st.segments[seq / segmentSize]
+    forgotten := seq <= st.bound
+    st.lock.RUnlock()
+    if forgotten {
+        return nil
+    }
+    if seg != nil || !create {
+        return seg
+    }
+
+    st.lock.Lock()
+    defer st.lock.Unlock()
+
+    if seq <= st.bound {
+        return nil
+    }
+    seg = st.segments[seq / segmentSize]
+    if seg == nil {
+        seg = &segment{}
+        st.segments[seq / segmentSize] = seg
+    }
+    return seg
+}
+
+func (st *InstanceStore) Get(seq int) (interface{}, bool) {
+    seg := st.segment(seq, false)
+    if seg == nil {
+        return nil, false
+    }
+    seg.lock.RLock()
+    defer seg.lock.RUnlock()
+
+    i := seq % segmentSize
+    return seg.values[i], seg.used & (1 << uint(i)) != 0
+}
+
+// Returns false if seq <= bound, as the instance is already forgotten
+func (st *InstanceStore) Put(seq int, v interface{}) bool {
+    seg := st.segment(seq, true)
+    if seg == nil {
+        return false
+    }
+    seg.lock.Lock()
+    defer seg.lock.Unlock()
+
+    i := seq % segmentSize
+    seg.values[i] = v
+    seg.used |= 1 << uint(i)
+    return true
+}
+
+// The value of seq, set to create() first if there is none
+// Returns false if seq <= bound, as the instance is already forgotten
+func (st *InstanceStore) GetOrCreate(seq int, create func() interface{}) (interface{}, bool) {
+    seg := st.segment(seq, true)
+    if seg == nil {
+        return nil, false
+    }
+    seg.lock.Lock()
+    defer seg.lock.Unlock()
+
+    i := seq % segmentSize
+    if seg.used & (1 << uint(i)) == 0 {
+        seg.values[i] = create()
+        seg.used |= 1 << uint(i)
+    }
+    return seg.values[i], true
+}
+
+// Forget every instance <= bound
+// The segments below bound are dropped whole, so the cost only depends on
+// how many segments are dropped, not on how many instances they hold.
+func (st *InstanceStore) Truncate(bound int) {
+    st.lock.Lock()
+    defer st.lock.Unlock()
+
+    if bound <= st.bound {
+        return
+    }
+    st.bound = bound
+
+    last := (bound + 1) / segmentSize   // the first segment to keep
+    if last - st.first > len(st.segments) {
+        // Far jump, only look at the segments that exist
+        for index, _ := range st.segments {
+            if index < last {
+                delete(st.segments, index)
+            }
+        }
+    } else {
+        for index := st.first; index < last; index++ {
+            delete(st.segments, index)
+        }
+    }
+    if last > st.first {
+        st.first = last
+    }
+
+    // The segment of bound is kept, without the instances <= bound
+    if seg := st.segments[bound / segmentSize]; seg != nil {
+        seg.lock.Lock()
+        for i := 0; i <= bound % segmentSize; i++ {
+            seg.values[i] = nil
+        }
+        seg.used &^= (1 << uint(bound % segmentSize + 1)) - 1
+        seg.lock.Unlock()
+    }
+}
+
+func (st *InstanceStore) Bound() int {
+    st.lock.RLock()
+    defer st.lock.RUnlock()
+
+    return st.bound
+}
+
+// Call f on every instance in order
+// f may use the store, as no lock is held while it runs.
+func (st *InstanceStore) Range(f func(seq int, v interface{})) {
+    st.lock.RLock()
+    indexes := make([]int, 0, len(st.segments))
+    for index, _ := range st.segments {
+        indexes = append(indexes, index)
+    }
+    sort.Ints(indexes)
+    segments := make([]*segment, len(indexes))
+    for i, index := range indexes {
+        segments[i] = st.segments[index]
+    }
+    bound := st.bound
+    st.lock.RUnlock()
+
+    for k, seg := range segments {
+        seg.lock.RLock()
+        used := seg.used
+        values := seg.values
+        seg.lock.RUnlock()
+        for i := 0; i < segmentSize; i++ {
+            seq := indexes[k] * segmentSize + i
+            if used & (1 << uint(i)) != 0 && seq > bound {
+                f(seq, values[i])
+            }
+        }
+    }
+}
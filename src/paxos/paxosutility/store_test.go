@@ -0,0 +1,81 @@
+package paxosutility
+
+import "testing"
+import "fmt"
+import "sync"
+
+func TestInstanceStore(t *testing.T) {
+    fmt.Printf("Test: Instance store truncates prefixes ...\n")
+
+    st := NewInstanceStore()
+    for seq := 0; seq < 200; seq++ {
+        if !st.Put(seq, seq) {
+            t.Fatalf("Put(%v) refused", seq)
+        }
+    }
+
+    st.Truncate(100)
+    for seq := 0; seq < 200; seq++ {
+        v, exist := st.Get(seq)
+        if exist != (seq > 100) || (exist && v != seq) {
+            t.Fatalf("Get(%v) = %v %v after Truncate(100)", seq, v, exist)
+        }
+    }
+    if st.Put(50, 50) {
+        t.Fatalf("Put below the bound accepted")
+    }
+    if _, ok := st.GetOrCreate(100, func() interface{} { return 0 }); ok {
+        t.Fatalf("GetOrCreate at the bound accepted")
+    }
+
+    next := 101
+    st.Range(func(seq int, v interface{}) {
+        if seq != next || v != seq {
+            t.Fatalf("Range gave %v %v; wanted %v in order", seq, v, next)
+        }
+        next++
+    })
+    if next != 200 {
+        t.Fatalf("Range stopped at %v", next)
+    }
+
+    // a far jump only visits the segments that exist
+    st.Put(1 << 40, "far")
+    st.Truncate(1 << 39)
+    if _, exist := st.Get(199); exist {
+        t.Fatalf("instance below the bound kept")
+    }
+    if v, _ := st.Get(1 << 40); v != "far" {
+        t.Fatalf("instance above the bound lost")
+    }
+
+    fmt.Printf("  ... Passed\n")
+
+    fmt.Printf("Test: Instance store under concurrent access ...\n")
+
+    st = NewInstanceStore()
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            for seq := i; seq < 10000; seq += 8 {
+                data, _ := st.GetOrCreate(seq, func() interface{} { return seq })
+                if data != nil && data != seq {
+                    t.Errorf("GetOrCreate(%v) = %v", seq, data)
+                }
+                if seq % 100 == 0 {
+                    st.Truncate(seq - 1000)
+                }
+            }
+        }(i)
+    }
+    wg.Wait()
+    for seq := st.Bound() + 1; seq < 10000; seq++ {
+        if v, exist := st.Get(seq); !exist || v != seq {
+            t.Fatalf("Get(%v) = %v %v", seq, v, exist)
+        }
+    }
+
+    fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,380 @@
+package paxos
+
+import (
+    "bytes"
+    "context"
+    "encoding/gob"
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "math/rand"
+    "net"
+    "reflect"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Deterministic simulation
+//
+// A Sim runs a group of peers on a virtual clock. RPCs, timers and the
+// operations scheduled with At are events. The Sim waits until every
+// goroutine of the peers is blocked on the Sim, then runs the earliest
+// event, so that the peers never race with each other.
+// Whether an RPC is lost, and how late it is, only depends on the seed,
+// the time and the RPC, so a run is reproduced from its seed.
+
+const simTimeout = 100 * time.Millisecond  // until a lost RPC fails
+
+type Sim struct {
+    seed int64
+    rand *rand.Rand
+    now time.Duration
+    events []*simEvent
+    nevents int
+    running int     // goroutines of the peers that are not blocked
+    peers map[string]*Paxos
+    drop float64
+    delay time.Duration
+    partition [][]string
+    lock sync.Mutex
+    idle *sync.Cond
+}
+
+type simEvent struct {
+    at time.Duration
+    key string      // orders the events at the same time
+    run func()
+}
+
+func NewSim(seed int64) *Sim {
+    sim := &Sim{}
+    sim.seed = seed
+    sim.rand = rand.New(rand.NewSource(seed))
+    sim.peers = make(map[string]*Paxos)
+    sim.delay = 10 * time.Millisecond
+    sim.idle = sync.NewCond(&sim.lock)
+    return sim
+}
+
+// A peer that runs in the simulation
+func (sim *Sim) Make(peers []string, me int) *Paxos {
+    px := MakeWithTransport(peers, me, nil, "", &simTransport{sim, peers[me]})
+    px.SetClock(sim)
+
+    sim.lock.Lock()
+    defer sim.lock.Unlock()
+
+    sim.peers[peers[me]] = px
+    return px
+}
+
+// Random numbers for the schedule of a test, drawn from the seed
+func (sim *Sim) Rand() *rand.Rand {
+    return sim.rand
+}
+
+func (sim *Sim) SetDrop(p float64) {
+    sim.lock.Lock()
+    defer sim.lock.Unlock()
+
+    sim.drop = p
+}
+
+// Every RPC takes up to delay
+func (sim *Sim) SetDelay(delay time.Duration) {
+    sim.lock.Lock()
+    defer sim.lock.Unlock()
+
+    sim.delay = delay
+}
+
+// Peers in different groups cannot talk to each other
+// No groups heal the partition
+func (sim *Sim) Partition(groups ...[]string) {
+    sim.lock.Lock()
+    defer sim.lock.Unlock()
+
+    sim.partition = groups
+}
+
+// Run f at time t
+func (sim *Sim) At(t time.Duration, f func()) {
+    sim.lock.Lock()
+    defer sim.lock.Unlock()
+
+    sim.schedule(t, fmt.Sprintf("op|%08d", sim.nevents), f)
+}
+
+// Run the events until time t
+func (sim *Sim) Run(t time.Duration) {
+    for {
+        sim.lock.Lock()
+        for sim.running > 0 {
+            sim.idle.Wait()
+        }
+        ev := sim.next(t)
+        if ev == nil {
+            sim.now = t
+            sim.lock.Unlock()
+            return
+        }
+        sim.now = ev.at
+        sim.lock.Unlock()
+
+        ev.run()
+    }
+}
+
+// With lock held
+func (sim *Sim) schedule(at time.Duration, key string, run func()) {
+    sim.nevents++
+    sim.events = append(sim.events, &simEvent{at, key, run})
+}
+
+// Remove and return the earliest event up to time t, with lock held
+func (sim *Sim) next(t time.Duration) *simEvent {
+    best := -1
+    for i, ev := range sim.events {
+        if ev.at > t {
+            continue
+        }
+        if best < 0 || ev.at < sim.events[best].at || (ev.at == sim.events[best].at && ev.key < sim.events[best].key) {
+            best = i
+        }
+    }
+    if best < 0 {
+        return nil
+    }
+    ev := sim.events[best]
+    sim.events[best] = sim.events[len(sim.events) - 1]
+    sim.events = sim.events[:len(sim.events) - 1]
+    return ev
+}
+
+// With lock held
+func (sim *Sim) block() {
+    sim.running--
+    if sim.running == 0 {
+        sim.idle.Broadcast()
+    }
+}
+
+func (sim *Sim) unblock() {
+    sim.lock.Lock()
+    defer sim.lock.Unlock()
+
+    sim.running++
+}
+
+//--------------------------------------------------//
+
+// Clock
+
+func (sim *Sim) Now() time.Time {
+    sim.lock.Lock()
+    defer sim.lock.Unlock()
+
+    return time.Unix(0, 0).Add(sim.now)
+}
+
+func (sim *Sim) Sleep(d time.Duration) {
+    ch := make(chan bool)
+    sim.lock.Lock()
+    sim.schedule(sim.now + d, fmt.Sprintf("sleep|%08d", sim.nevents), func() {
+        sim.unblock()
+        close(ch)
+    })
+    sim.block()
+    sim.lock.Unlock()
+    <-ch
+}
+
+func (sim *Sim) Go(f func()) {
+    sim.unblock()
+    go func() {
+        f()
+        sim.lock.Lock()
+        sim.block()
+        sim.lock.Unlock()
+    }()
+}
+
+func (sim *Sim) Mailbox(n int) Mailbox {
+    return &simMailbox{sim, sync.NewCond(&sim.lock), nil, false}
+}
+
+type simMailbox struct {
+    sim *Sim
+    cond *sync.Cond
+    values []interface{}
+    waiting bool
+}
+
+func (mb *simMailbox) Put(v interface{}) {
+    mb.sim.lock.Lock()
+    defer mb.sim.lock.Unlock()
+
+    mb.values = append(mb.values, v)
+    if mb.waiting {
+        mb.waiting = false
+        mb.sim.running++
+        mb.cond.Signal()
+    }
+}
+
+func (mb *simMailbox) Get() interface{} {
+    mb.sim.lock.Lock()
+    defer mb.sim.lock.Unlock()
+
+    for len(mb.values) == 0 {
+        if !mb.waiting {
+            mb.waiting = true
+            mb.sim.block()
+        }
+        mb.cond.Wait()
+    }
+    v := mb.values[0]
+    mb.values = mb.values[1:]
+    return v
+}
+
+//--------------------------------------------------//
+
+// Transport
+// An RPC is delivered by calling the handler of the peer directly, with
+// copies of the arguments and the reply
+
+type simTransport struct {
+    sim *Sim
+    self string
+}
+
+func (st *simTransport) Listen(addr string) (net.Listener, error) {
+    return &simListener{addr, make(chan bool), sync.Once{}}, nil
+}
+
+func (st *simTransport) Close() {
+}
+
+// The fate of an RPC from the seed, the time and the RPC
+func (sim *Sim) fate(key string) *fate {
+    h := fnv.New64a()
+    fmt.Fprintf(h, "%d|%d|%s", sim.seed, sim.now, key)
+    f := fate(h.Sum64())
+    return &f
+}
+
+// splitmix64
+type fate uint64
+
+func (f *fate) next() uint64 {
+    *f += 0x9e3779b97f4a7c15
+    z := uint64(*f)
+    z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+    z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+    return z ^ (z >> 31)
+}
+
+func (f *fate) Float64() float64 {
+    return float64(f.next() >> 11) / (1 << 53)
+}
+
+func (f *fate) Int63n(n int64) int64 {
+    return int64(f.next() >> 1) % n
+}
+
+// With lock held
+func (sim *Sim) blocked(src string, dst string) bool {
+    g1 := group(sim.partition, src)
+    g2 := group(sim.partition, dst)
+    return g1 >= 0 && g2 >= 0 && g1 != g2
+}
+
+// The deadline of ctx is in real time, so only a cancelled ctx counts
+func (st *simTransport) Call(ctx context.Context, srv string, name string, args interface{}, reply interface{}) bool {
+    sim := st.sim
+    if ctx.Err() == context.Canceled {
+        return false
+    }
+    buf := bytes.Buffer{}
+    if gob.NewEncoder(&buf).Encode(args) != nil {
+        return false
+    }
+    key := fmt.Sprintf("rpc|%s|%s|%s|%x", st.self, srv, name, buf.Bytes())
+
+    ch := make(chan bool)
+    sim.lock.Lock()
+    r := sim.fate(key)
+    lost := r.Float64() < sim.drop
+    replyLost := r.Float64() < sim.drop
+    delay := time.Millisecond
+    if sim.delay > delay {
+        delay += time.Duration(r.Int63n(int64(sim.delay - delay)))
+    }
+    if lost || sim.blocked(st.self, srv) {
+        delay = simTimeout
+    }
+    sim.schedule(sim.now + delay, key, func() {
+        ok := false
+        sim.lock.Lock()
+        px := sim.peers[srv]
+        if lost || sim.blocked(st.self, srv) {
+            px = nil
+        }
+        sim.lock.Unlock()
+        if px != nil && !px.isdead() {
+            ok = deliver(px, name, buf.Bytes(), reply) == nil && !replyLost
+        }
+        sim.unblock()
+        ch <- ok
+    })
+    sim.block()
+    sim.lock.Unlock()
+    return <-ch
+}
+
+// Call the handler name of px
+func deliver(px *Paxos, name string, args []byte, reply interface{}) error {
+    method := reflect.ValueOf(px).MethodByName(name[strings.Index(name, ".") + 1:])
+    if !method.IsValid() {
+        return errors.New("no method " + name)
+    }
+    a := reflect.New(method.Type().In(0))
+    if err := gob.NewDecoder(bytes.NewReader(args)).Decode(a.Interface()); err != nil {
+        return err
+    }
+    r := reflect.New(method.Type().In(1).Elem())
+    result := method.Call([]reflect.Value{a.Elem(), r})
+    if err, _ := result[0].Interface().(error); err != nil {
+        return err
+    }
+
+    buf := bytes.Buffer{}
+    if err := gob.NewEncoder(&buf).Encode(r.Interface()); err != nil {
+        return err
+    }
+    return gob.NewDecoder(&buf).Decode(reply)
+}
+
+type simListener struct {
+    addr string
+    done chan bool
+    once sync.Once
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+    <-l.done
+    return nil, errors.New("use of closed listener")
+}
+
+func (l *simListener) Close() error {
+    l.once.Do(func() {
+        close(l.done)
+    })
+    return nil
+}
+
+func (l *simListener) Addr() net.Addr {
+    return memAddr(l.addr)
+}
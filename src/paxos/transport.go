@@ -0,0 +1,236 @@
+package paxos
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "net/rpc"
+    "sync"
+    "syscall"
+)
+
+// Transport carries the RPCs between paxos peers
+type Transport interface {
+    // Listen for connections to addr
+    Listen(addr string) (net.Listener, error)
+    // Send an RPC to srv and wait for the reply, until ctx is done
+    Call(ctx context.Context, srv string, name string, args interface{}, reply interface{}) bool
+    // Drop every cached connection
+    Close()
+}
+
+//--------------------------------------------------//
+
+// Connection pool shared by the transports
+// A connection is kept open across RPCs, and dialed again once it breaks
+// or an RPC on it times out
+
+type poolTransport struct {
+    dial func(ctx context.Context, srv string) (net.Conn, error)
+    listen func(addr string) (net.Listener, error)
+    clients map[string]*rpc.Client
+    closed bool
+    lock sync.Mutex
+}
+
+func newPoolTransport(dial func(context.Context, string) (net.Conn, error), listen func(string) (net.Listener, error)) *poolTransport {
+    return &poolTransport{dial, listen, make(map[string]*rpc.Client), false, sync.Mutex{}}
+}
+
+func (tr *poolTransport) Listen(addr string) (net.Listener, error) {
+    return tr.listen(addr)
+}
+
+func (tr *poolTransport) client(ctx context.Context, srv string) (*rpc.Client, error) {
+    tr.lock.Lock()
+    c, exist := tr.clients[srv]
+    tr.lock.Unlock()
+    if exist {
+        return c, nil
+    }
+
+    // Dial without the lock, so a dead peer does not block the others
+    conn, err := tr.dial(ctx, srv)
+    if err != nil {
+        return nil, err
+    }
+    c = rpc.NewClient(conn)
+
+    tr.lock.Lock()
+    defer tr.lock.Unlock()
+
+    if tr.closed {
+        c.Close()
+        return nil, rpc.ErrShutdown
+    }
+    if old, exist := tr.clients[srv]; exist {
+        c.Close()
+        return old, nil
+    }
+    tr.clients[srv] = c
+    return c, nil
+}
+
+func (tr *poolTransport) drop(srv string, c *rpc.Client) {
+    tr.lock.Lock()
+    defer tr.lock.Unlock()
+
+    if tr.clients[srv] == c {
+        delete(tr.clients, srv)
+    }
+    c.Close()
+}
+
+func (tr *poolTransport) Call(ctx context.Context, srv string, name string, args interface{}, reply interface{}) bool {
+    c, err := tr.client(ctx, srv)
+    if err != nil {
+        return false
+    }
+
+    stop := context.AfterFunc(ctx, func() {
+        // The peer may never answer on this connection
+        tr.drop(srv, c)
+    })
+    defer stop()
+
+    err = c.Call(name, args, reply)
+    if err == nil {
+        return true
+    }
+
+    // The connection is still usable if only the handler failed
+    if _, ok := err.(rpc.ServerError); !ok {
+        tr.drop(srv, c)
+    }
+    return false
+}
+
+func (tr *poolTransport) Close() {
+    tr.lock.Lock()
+    defer tr.lock.Unlock()
+
+    for srv, c := range tr.clients {
+        c.Close()
+        delete(tr.clients, srv)
+    }
+    tr.closed = true
+}
+
+//--------------------------------------------------//
+
+// TCP transport
+
+func NewTCPTransport() Transport {
+    dial := func(ctx context.Context, srv string) (net.Conn, error) {
+        conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", srv)
+        if err != nil && ctx.Err() == nil {
+            err1, ok := err.(*net.OpError)
+            if !ok || (!errors.Is(err1.Err, syscall.ENOENT) && !errors.Is(err1.Err, syscall.ECONNREFUSED)) {
+                fmt.Printf("paxos Dial() failed: %v\n", err)
+            }
+        }
+        return conn, err
+    }
+    listen := func(addr string) (net.Listener, error) {
+        return net.Listen("tcp", addr)
+    }
+    return newPoolTransport(dial, listen)
+}
+
+//--------------------------------------------------//
+
+// In-memory transport for tests
+// Every peer of a MemNetwork gets its own Transport, and connections
+// between them are net.Pipe()
+
+type MemNetwork struct {
+    listeners map[string]*memListener
+    lock sync.Mutex
+}
+
+func NewMemNetwork() *MemNetwork {
+    return &MemNetwork{make(map[string]*memListener), sync.Mutex{}}
+}
+
+func (mn *MemNetwork) Transport() Transport {
+    return newPoolTransport(mn.dial, mn.listen)
+}
+
+func (mn *MemNetwork) listen(addr string) (net.Listener, error) {
+    mn.lock.Lock()
+    defer mn.lock.Unlock()
+
+    if _, exist := mn.listeners[addr]; exist {
+        return nil, errors.New("address already in use: " + addr)
+    }
+    l := &memListener{mn, addr, make(chan net.Conn), make(chan bool), sync.Once{}}
+    mn.listeners[addr] = l
+    return l, nil
+}
+
+func (mn *MemNetwork) dial(ctx context.Context, srv string) (net.Conn, error) {
+    mn.lock.Lock()
+    l, exist := mn.listeners[srv]
+    mn.lock.Unlock()
+    if !exist {
+        return nil, errors.New("connection refused: " + srv)
+    }
+
+    c1, c2 := net.Pipe()
+    select {
+    case l.conns <- c2:
+        return c1, nil
+    case <-l.done:
+        c1.Close()
+        c2.Close()
+        return nil, errors.New("connection refused: " + srv)
+    case <-ctx.Done():
+        c1.Close()
+        c2.Close()
+        return nil, ctx.Err()
+    }
+}
+
+type memAddr string
+
+func (a memAddr) Network() string {
+    return "mem"
+}
+
+func (a memAddr) String() string {
+    return string(a)
+}
+
+type memListener struct {
+    mn *MemNetwork
+    addr string
+    conns chan net.Conn
+    done chan bool
+    once sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+    select {
+    case c := <-l.conns:
+        return c, nil
+    case <-l.done:
+        return nil, errors.New("use of closed listener")
+    }
+}
+
+func (l *memListener) Close() error {
+    l.once.Do(func() {
+        l.mn.lock.Lock()
+        if l.mn.listeners[l.addr] == l {
+            delete(l.mn.listeners, l.addr)
+        }
+        l.mn.lock.Unlock()
+        close(l.done)
+    })
+    return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+    return memAddr(l.addr)
+}
@@ -9,55 +9,96 @@ import (
     "io/ioutil"
     "net/http"
     "os"
+    "strconv"
+    "strings"
+    "time"
 )
 
 var data *kvpaxos.KVPaxosMap
 var nodeId int
 var peers []string
+var first []string
 var port string
+var dataDir string
 
-// Load configuration from "conf/settings.conf"
-// Get all replicas' ip and port
+// Load configuration from "conf/settings.conf" at startup
 func loadConfig() error {
+    var err error
+    port, peers, first, err = readConfig()
+    return err
+}
+
+// Read "conf/settings.conf"
+// Get the port, all replicas' ip and port, and the replicas the group
+// started with in "members", if not all of them
+func readConfig() (string, []string, []string, error) {
     bytes, err := ioutil.ReadFile("conf/settings.conf")
     if err != nil {
-        return err
+        return "", nil, nil, err
     }
 
     var config map[string]string
     err = json.Unmarshal(bytes, &config)
     if err != nil {
-        return err
+        return "", nil, nil, err
     }
 
-    var exist bool
-    port, exist = config["port"]
+    port, exist := config["port"]
     if !exist {
-        return errors.New("config file error")
+        return "", nil, nil, errors.New("config file error")
     }
     port = ":" + port
 
     delete(config, "port")
+    members, exist := config["members"]
+    delete(config, "members")
     if (len(config) >= 100) {
-        return errors.New("config file error")
+        return "", nil, nil, errors.New("config file error")
     }
-    peers = make([]string, len(config))
+    peers := make([]string, len(config))
 
     for i := 0; i < len(peers); i++ {
         peer, exist := config[fmt.Sprintf("n%02d", i + 1)]
         if !exist {
-            return errors.New("config file error")
+            return "", nil, nil, errors.New("config file error")
         }
         peers[i] = peer
     }
-    return nil
+
+    first := peers
+    if exist {
+        first, err = selectPeers(peers, members)
+    }
+    return port, peers, first, err
+}
+
+// The slots of the replicas of peers in a list like "n01,n02,n04"
+// Replicas out of the list are ""
+func selectPeers(peers []string, members string) ([]string, error) {
+    result := make([]string, len(peers))
+    for _, member := range strings.Split(members, ",") {
+        id := 0
+        if n, err := fmt.Sscanf(member, "n%d", &id); n != 1 || err != nil {
+            return nil, errors.New("members format error")
+        }
+        if !(0 < id && id <= len(peers)) {
+            return nil, errors.New("node id range error")
+        }
+        result[id - 1] = peers[id - 1]
+    }
+    return result, nil
 }
 
 // Analyse the command-line arguments and get the node id
+// Usage: start_server n<id> [data dir]
+// Without a data dir the replica keeps everything in memory
 func loadNodeId() error {
-    if (len(os.Args) != 2) {
+    if (len(os.Args) != 2 && len(os.Args) != 3) {
         return errors.New("command line arguments error")
     }
+    if len(os.Args) == 3 {
+        dataDir = os.Args[2]
+    }
     if n, err := fmt.Sscanf(os.Args[1], "n%d", &nodeId); n != 1 || err != nil {
         return errors.New("command line arguments error")
     }
@@ -67,6 +108,50 @@ func loadNodeId() error {
     return nil
 }
 
+// The session of a request in client=c&seq=n, if any
+// A retried request must carry the same numbers
+func loadSession(request *http.Request) (kvpaxos.Session, error) {
+    s := kvpaxos.Session{}
+    clients, found_client := request.Form["client"]
+    seqs, found_seq := request.Form["seq"]
+    if !found_client && !found_seq {
+        return s, nil
+    }
+    if !(found_client && found_seq) {
+        return s, errors.New("session format error")
+    }
+
+    var err error
+    s.Client, err = strconv.ParseInt(clients[0], 10, 64)
+    if err != nil {
+        return s, err
+    }
+    s.Seq, err = strconv.Atoi(seqs[0])
+    if err != nil {
+        return s, err
+    }
+    if s.Client == 0 || s.Seq <= 0 {
+        return s, errors.New("session format error")
+    }
+    return s, nil
+}
+
+// The TTL of a write in ttl=ms, 0 if none
+func loadTTL(request *http.Request) (time.Duration, error) {
+    ttls, found_ttl := request.Form["ttl"]
+    if !found_ttl {
+        return 0, nil
+    }
+    ms, err := strconv.ParseInt(ttls[0], 10, 64)
+    if err != nil {
+        return 0, err
+    }
+    if ms <= 0 {
+        return 0, errors.New("ttl range error")
+    }
+    return time.Duration(ms) * time.Millisecond, nil
+}
+
 func startServer() {
     mux := http.NewServeMux()
     mux.HandleFunc("/", handleRoot)
@@ -74,9 +159,14 @@ func startServer() {
     mux.HandleFunc("/kv/delete", handleDelete)
     mux.HandleFunc("/kv/get", handleGet)
     mux.HandleFunc("/kv/update", handleUpdate)
+    mux.HandleFunc("/kv/cas", handleCompareAndSwap)
+    mux.HandleFunc("/kv/txn", handleTransaction)
     mux.HandleFunc("/kvman/countkey", handleCountkey)
     mux.HandleFunc("/kvman/dump", handleDump)
     mux.HandleFunc("/kvman/shutdown", handleShutdown)
+    mux.HandleFunc("/kvman/reconfig", handleReconfig)
+    mux.HandleFunc("/kvman/faults", handleFaults)
+    mux.HandleFunc("/kvman/partition", handlePartition)
     http.ListenAndServe(port, mux)
 }
 
@@ -93,7 +183,7 @@ func main() {
         return
     }
 
-    data = kvpaxos.NewKVPaxosMap(peers, nodeId - 1)
+    data = kvpaxos.NewKVPaxosMapWithConfig(peers, first, nodeId - 1, dataDir)
 
     startServer()
 }
@@ -132,6 +222,14 @@ func handleRoot(wfile http.ResponseWriter, request *http.Request) {
     <input type="submit" value="submit" />
   </form>
 
+  <p>Replace the value of a key if it is the expected one</p>
+  <form action="/kv/cas" method="post">
+    <p>Key: <input type="text" name="key" /></p>
+    <p>Expected: <input type="text" name="expected" /></p>
+    <p>Value: <input type="text" name="value" /></p>
+    <input type="submit" value="submit" />
+  </form>
+
   <form action="/kvman/countkey" method="get">
     <input type="submit" value="countkey" />
   </form>
@@ -148,7 +246,7 @@ func handleRoot(wfile http.ResponseWriter, request *http.Request) {
 }
 
 // Method: POST
-// Arguments: key=k&value=v
+// Arguments: key=k&value=v, and optionally ttl=ms and client=c&seq=n
 // Return: {"success":"<true or false>"}
 func handleInsert(wfile http.ResponseWriter, request *http.Request) {
     err := request.ParseForm()
@@ -171,8 +269,25 @@ func handleInsert(wfile http.ResponseWriter, request *http.Request) {
         return
     }
 
-    ok := data.Put(key, value)
-    if ok {
+    session, err := loadSession(request)
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    ttl, err := loadTTL(request)
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    var ok bool
+    if ttl > 0 {
+        ok, err = data.PutTTLIn(session, key, value, ttl)
+    } else {
+        ok, err = data.PutIn(session, key, value)
+    }
+    if err == nil && ok {
         fmt.Fprintf(wfile, `{"success":"true"}`)
     } else {
         fmt.Fprintf(wfile, `{"success":"false"}`)
@@ -180,7 +295,7 @@ func handleInsert(wfile http.ResponseWriter, request *http.Request) {
 }
 
 // Method: POST
-// Arguments: key=k
+// Arguments: key=k, and optionally client=c&seq=n
 // Return: {"success":"<true or false>","value":"<value deleted>"}
 func handleDelete(wfile http.ResponseWriter, request *http.Request) {
     err := request.ParseForm()
@@ -201,9 +316,15 @@ func handleDelete(wfile http.ResponseWriter, request *http.Request) {
         return
     }
 
-    ok, value := data.Delete(key)
-    if ok {
-        fmt.Fprintf(wfile, `{"success":"true","value":"` + value + `"}`)
+    session, err := loadSession(request)
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false","value":""}`)
+        return
+    }
+
+    ok, value, err := data.DeleteIn(session, key)
+    if err == nil && ok {
+        fmt.Fprint(wfile, `{"success":"true","value":"` + value + `"}`)
     } else {
         fmt.Fprintf(wfile, `{"success":"false","value":""}`)
     }
@@ -225,16 +346,16 @@ func handleGet(wfile http.ResponseWriter, request *http.Request) {
         return
     }
 
-    ok, value := data.Get(key)
-    if ok {
-        fmt.Fprintf(wfile, `{"success":"true","value":` + value + `"}`)
+    ok, value, err := data.Get(key)
+    if err == nil && ok {
+        fmt.Fprint(wfile, `{"success":"true","value":` + value + `"}`)
     } else {
         fmt.Fprintf(wfile, `{"success":"false","value":""}`)
     }
 }
 
 // Method: POST
-// Arguments: key=k&value=v
+// Arguments: key=k&value=v, and optionally ttl=ms and client=c&seq=n
 // Return: {"success":"<true or false>"}
 func handleUpdate(wfile http.ResponseWriter, request *http.Request) {
     err := request.ParseForm()
@@ -257,8 +378,103 @@ func handleUpdate(wfile http.ResponseWriter, request *http.Request) {
         return
     }
 
-    ok := data.Update(key, value)
-    if ok {
+    session, err := loadSession(request)
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    ttl, err := loadTTL(request)
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    var ok bool
+    if ttl > 0 {
+        ok, err = data.UpdateTTLIn(session, key, value, ttl)
+    } else {
+        ok, err = data.UpdateIn(session, key, value)
+    }
+    if err == nil && ok {
+        fmt.Fprintf(wfile, `{"success":"true"}`)
+    } else {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+    }
+}
+
+// Method: POST
+// Arguments: key=k&expected=e&value=v, and optionally client=c&seq=n
+// Return: {"success":"<true or false>","value":"<value found>"}
+func handleCompareAndSwap(wfile http.ResponseWriter, request *http.Request) {
+    err := request.ParseForm()
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false","value":""}`)
+        return
+    }
+
+    keys, found_key := request.Form["key"]
+    expecteds, found_expected := request.Form["expected"]
+    values, found_value := request.Form["value"]
+    if !(found_key && found_expected && found_value) {
+        fmt.Fprintf(wfile, `{"success":"false","value":""}`)
+        return
+    }
+
+    key := keys[0]
+    expected := expecteds[0]
+    value := values[0]
+    if len(key) == 0 || len(expected) == 0 || len(value) == 0 {
+        fmt.Fprintf(wfile, `{"success":"false","value":""}`)
+        return
+    }
+
+    session, err := loadSession(request)
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false","value":""}`)
+        return
+    }
+
+    ok, found, err := data.CompareAndSwapIn(session, key, expected, value)
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false","value":""}`)
+    } else {
+        fmt.Fprint(wfile, `{"success":"` + strconv.FormatBool(ok) + `","value":"` + found + `"}`)
+    }
+}
+
+// Method: POST
+// Arguments: txn=t, and optionally client=c&seq=n
+// t is like {"checks":[{"key":"a","present":true,"value":"1"}],
+//            "mutations":[{"type":"Set","key":"b","value":"2"}]}
+// Return: {"success":"<true or false>"}
+func handleTransaction(wfile http.ResponseWriter, request *http.Request) {
+    err := request.ParseForm()
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    txns, found_txn := request.Form["txn"]
+    if !found_txn {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    var txn kvpaxos.Transaction
+    if json.Unmarshal([]byte(txns[0]), &txn) != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    session, err := loadSession(request)
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    ok, err := data.TransactIn(session, txn)
+    if err == nil && ok {
         fmt.Fprintf(wfile, `{"success":"true"}`)
     } else {
         fmt.Fprintf(wfile, `{"success":"false"}`)
@@ -267,14 +483,142 @@ func handleUpdate(wfile http.ResponseWriter, request *http.Request) {
 
 // Return {"result":"<number of keys>"}
 func handleCountkey(wfile http.ResponseWriter, request *http.Request) {
-    fmt.Fprintf(wfile, `{"result":"%d"}`, data.Count())
+    count, _ := data.Count()
+    fmt.Fprintf(wfile, `{"result":"%d"}`, count)
 }
 
 // Return [["<key>","<value>"], ...]
 func handleDump(wfile http.ResponseWriter, request *http.Request) {
-    fmt.Fprintf(wfile, data.Dump())
+    info, _ := data.Dump()
+    fmt.Fprint(wfile, info)
 }
 
 func handleShutdown(wfile http.ResponseWriter, request *http.Request) {
     data.Shutdown()
 }
+
+// Method: POST
+// Arguments: members=n01,n02,n04
+// Return: {"success":"<true or false>"}
+// New replicas must be added to "conf/settings.conf" first
+// The file is read again, and the globals read by the other handlers are
+// left alone
+func handleReconfig(wfile http.ResponseWriter, request *http.Request) {
+    err := request.ParseForm()
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    members, found_members := request.Form["members"]
+    if !found_members {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    _, latest, _, err := readConfig()
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    slots, err := selectPeers(latest, members[0])
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    if data.Reconfigure(slots) == nil {
+        fmt.Fprintf(wfile, `{"success":"true"}`)
+    } else {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+    }
+}
+
+// Method: POST
+// Arguments: drop=p&dropreply=p&delay=ms&reorder=p&hold=ms, all optional
+// Return: {"success":"<true or false>"}
+// Only the RPCs sent by this replica are affected
+func handleFaults(wfile http.ResponseWriter, request *http.Request) {
+    err := request.ParseForm()
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    value := func(name string, def float64) float64 {
+        if values, found := request.Form[name]; found && err == nil {
+            var v float64
+            v, err = strconv.ParseFloat(values[0], 64)
+            return v
+        }
+        return def
+    }
+    drop := value("drop", 0)
+    dropreply := value("dropreply", 0)
+    delay := value("delay", 0)
+    reorder := value("reorder", 0)
+    hold := value("hold", 0)
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    faults := data.Faults()
+    faults.SetDrop(drop)
+    faults.SetDropReply(dropreply)
+    faults.SetDelay(time.Duration(delay * float64(time.Millisecond)))
+    faults.SetReorder(reorder, time.Duration(hold * float64(time.Millisecond)))
+    fmt.Fprintf(wfile, `{"success":"true"}`)
+}
+
+// Method: POST
+// Arguments: name=p&groups=n01,n02;n03
+// Return: {"success":"<true or false>"}
+// Without groups the partition is healed
+// Only the RPCs sent by this replica are affected
+func handlePartition(wfile http.ResponseWriter, request *http.Request) {
+    err := request.ParseForm()
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    names, found_name := request.Form["name"]
+    if !found_name || len(names[0]) == 0 {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    groups, found_groups := request.Form["groups"]
+    if !found_groups || len(groups[0]) == 0 {
+        data.Faults().Heal(names[0])
+        fmt.Fprintf(wfile, `{"success":"true"}`)
+        return
+    }
+
+    // The replicas added since startup are only in the file
+    _, latest, _, err := readConfig()
+    if err != nil {
+        fmt.Fprintf(wfile, `{"success":"false"}`)
+        return
+    }
+
+    partition := make([][]string, 0)
+    for _, group := range strings.Split(groups[0], ";") {
+        slots, err := selectPeers(latest, group)
+        if err != nil {
+            fmt.Fprintf(wfile, `{"success":"false"}`)
+            return
+        }
+        addrs := make([]string, 0)
+        for _, addr := range slots {
+            if addr != "" {
+                addrs = append(addrs, addr)
+            }
+        }
+        partition = append(partition, addrs)
+    }
+    data.Faults().Partition(names[0], partition...)
+    fmt.Fprintf(wfile, `{"success":"true"}`)
+}